@@ -1,13 +1,6 @@
-// Copyright 2018 The go-github AUTHORS. All rights reserved.
-//
-// Use of this source code is governed by a BSD-style
-// license that can be found in the LICENSE file.
-
-// The newrepo command utilizes go-github as a cli tool for
-// creating new repositoriesDo. It takes an auth Token as
-// an enviroment variable and creates the new repo under
-// the account affiliated with that Token.
-package main
+// Package admin 通过 GitHub API 管理仓库、合作者、部署 key 和更新钩子，
+// 与部署服务共用同一份配置文件。
+package admin
 
 import (
 	"context"
@@ -16,16 +9,16 @@ import (
 	"os"
 	"strconv"
 
-	"github.com/google/go-github/github"
+	gh "github.com/google/go-github/github"
 	"github.com/jessevdk/go-flags"
-	"golang.org/x/oauth2"
+	"github.com/xiaosumay/server-code-mgr/github"
+	"github.com/xiaosumay/server-code-mgr/utils"
 )
 
 var (
-	Owner   string
-	Token   string
-	version string
-	Secret  string
+	Owner  string
+	Token  string
+	Secret string
 )
 
 type CommandOptions struct {
@@ -42,15 +35,15 @@ type ObjectOptions struct {
 }
 
 type CommonOptions struct {
-	Token string `long:"token" description:"账户Token"`
-	Owner string `long:"owner" description:"账户名"`
-	Name  string `long:"name" description:"仓库名称"`
+	Config string `short:"c" long:"config" default:"/etc/code-get/repositories.conf" description:"配置文件"`
+	Token  string `long:"token" description:"账户Token"`
+	Owner  string `long:"owner" description:"账户名"`
+	Name   string `long:"name" description:"仓库名称"`
 }
 
 type RepoOptions struct {
 	Description string `long:"desc" description:"描述"`
 	Private     bool   `long:"private" description:"是否私有仓库"`
-	Since       int64  `long:"since" description:"虽然有这个字段，但我也不知道干啥用的"`
 }
 
 type InviteOptions struct {
@@ -58,15 +51,14 @@ type InviteOptions struct {
 }
 
 type DevKeyOptions struct {
-	Id       int64  `long:"deploy-id" description:"远程Key的唯一ID"`
-	Key      string `long:"key" description:"ssh的public key 字符串或文件名"`
-	Title    string `long:"title" description:"key的标题"`
-	ReadOnly bool   `long:"read-only" description:"此key是否只读"`
+	Id    int64  `long:"deploy-id" description:"远程Key的唯一ID"`
+	Key   string `long:"key" description:"ssh的public key 字符串或文件名，默认使用配置中项目私钥对应的公钥"`
+	Title string `long:"title" description:"key的标题"`
 }
 
 type WebHookOptions struct {
-	Secret string `long:"secret" description:"web hook Secret"`
-	Ip     string `long:"ip" description:"更新钩子触发的服务器IP"`
+	Secret string `long:"secret" description:"web hook Secret，默认使用配置中项目的 secret"`
+	Ip     string `long:"ip" description:"更新钩子触发的服务器IP，默认使用配置中的 public_url"`
 	Id     int64  `long:"hook-id" description:"钩子的唯一ID"`
 	Test   bool   `long:"test" description:"触发hook"`
 }
@@ -79,8 +71,6 @@ type Options struct {
 	InviteOpts  InviteOptions  `group:"Invite Options"`
 	DevKeyOpts  DevKeyOptions  `group:"DeployKey Options"`
 	WebHookOpts WebHookOptions `group:"WebHook Options"`
-
-	Version bool `long:"version" description:"版本信息"`
 }
 
 func DefaultValues(val string, fallback ...string) string {
@@ -96,41 +86,46 @@ func fatalln(a ...interface{}) {
 	os.Exit(1)
 }
 
-func main() {
-
+// Run 执行 code-get admin 子命令
+func Run(args []string) int {
 	var opts Options
 	var parser = flags.NewParser(&opts, flags.Default)
-	_, err := parser.Parse()
-	if err != nil {
-		os.Exit(1)
+	parser.Name = "code-get admin"
+
+	if _, err := parser.ParseArgs(args); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			return 0
+		}
+		return 2
 	}
 
-	if opts.Version {
-		fmt.Println(version, Token)
-		os.Exit(0)
+	if _, err := os.Stat(opts.CommonOpts.Config); err == nil {
+		utils.ParseConfig(opts.CommonOpts.Config)
 	}
 
-	Token = DefaultValues(
-		opts.CommonOpts.Token,
-		os.Getenv("GITHUB_AUTH_TOKEN"),
-		Token,
-	)
+	repo, _ := utils.GetRepo(opts.CommonOpts.Name)
+
+	token, err := github.APIToken(opts.CommonOpts.Token)
+	if err != nil {
+		fatalln(err)
+	}
+	Token = token
 
 	Owner = DefaultValues(
 		opts.CommonOpts.Owner,
 		os.Getenv("GITHUB_AUTH_OWNER"),
-		Owner,
+		repo.Owner,
+		utils.GetSettings().Owner,
 	)
 
 	Secret = DefaultValues(
 		opts.WebHookOpts.Secret,
+		repo.Secret,
 		os.Getenv("GITHUB_AUTH_SECRET"),
-		Secret,
 	)
 
-	if Token == "" || Owner == "" {
-		fmt.Println("Unauthorized: No Token present")
-		os.Exit(1)
+	if Owner == "" {
+		fatalln("Unauthorized: No Owner present")
 	}
 
 	if opts.ObjectOpts.Repositories {
@@ -144,17 +139,69 @@ func main() {
 	} else {
 		fatalln("你需要指定一个 Object Options")
 	}
+
+	return 0
 }
 
-func getClient(token string) (*github.Client, context.Context) {
-	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
-	tc := oauth2.NewClient(ctx, ts)
-	client := github.NewClient(tc)
+func getClient(token string) (*gh.Client, context.Context) {
+	client, ctx, err := github.NewClient(token)
+	if err != nil {
+		fatalln(err)
+	}
 
 	return client, ctx
 }
 
+// HookURL 返回更新钩子应当指向的地址，ip 为空时使用配置中的 public_url
+func HookURL(ip string) (string, error) {
+	if ip != "" {
+		return "http://" + ip + ":17293", nil
+	}
+
+	url := utils.GetSettings().PublicURL
+	if url == "" {
+		return "", fmt.Errorf("请在配置中设置 public_url 或使用 --ip")
+	}
+
+	return url, nil
+}
+
+// CreateWebHook 创建监听 events、以 json 发送、使用给定 secret 签名的更新钩子，
+// events 通常取自 github.HookEvents
+func CreateWebHook(client *gh.Client, ctx context.Context, owner, name, url, secret string, events []string) (*gh.Hook, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("项目 %s 没有配置 secret", name)
+	}
+
+	active := true
+	hookName := "web"
+	hook, _, err := client.Repositories.CreateHook(ctx, owner, name, &gh.Hook{
+		Name: &hookName,
+		Config: map[string]interface{}{
+			"url":          url,
+			"content_type": "json",
+			"secret":       secret,
+			"insecure_ssl": "0",
+		},
+		Events: events,
+		Active: &active,
+	})
+
+	return hook, err
+}
+
+// CreateDeployKey 添加部署 key，部署 key 总是只读的
+func CreateDeployKey(client *gh.Client, ctx context.Context, owner, name, title, key string) (*gh.Key, error) {
+	readOnly := true
+	created, _, err := client.Repositories.CreateKey(ctx, owner, name, &gh.Key{
+		Key:      &key,
+		Title:    &title,
+		ReadOnly: &readOnly,
+	})
+
+	return created, err
+}
+
 func repositoriesDo(opts Options) {
 
 	client, ctx := getClient(Token)
@@ -170,7 +217,7 @@ func repositoriesDo(opts Options) {
 			fmt.Println("必须开启 --private 此项才能是创建私有仓库")
 		}
 
-		r := &github.Repository{
+		r := &gh.Repository{
 			Name:        &opts.CommonOpts.Name,
 			Private:     &options.Private,
 			Description: &options.Description,
@@ -182,11 +229,11 @@ func repositoriesDo(opts Options) {
 
 		fmt.Printf("Successfully created new repo: %v\n", repo.GetSSHURL())
 	} else if opts.CommandOpts.List {
-		reps, resp, err := client.Repositories.List(ctx, "", &github.RepositoryListOptions{
+		reps, _, err := client.Repositories.List(ctx, "", &gh.RepositoryListOptions{
 			Visibility: "all",
 		})
 
-		if err != nil || resp.StatusCode != 200 {
+		if err != nil {
 			fatalln(err)
 		}
 
@@ -219,7 +266,7 @@ func collaborators(opts Options) {
 		_, err := client.Repositories.AddCollaborator(ctx, Owner,
 			opts.CommonOpts.Name,
 			invite.GithubId,
-			&github.RepositoryAddCollaboratorOptions{
+			&gh.RepositoryAddCollaboratorOptions{
 				Permission: "push",
 			})
 
@@ -227,7 +274,7 @@ func collaborators(opts Options) {
 			fatalln(err)
 		}
 
-		fmt.Println("https://github.com/MLTechMy/" + opts.CommonOpts.Name + "/invitations")
+		fmt.Println("https://github.com/" + Owner + "/" + opts.CommonOpts.Name + "/invitations")
 	} else if opts.CommandOpts.List {
 		if opts.CommonOpts.Name == "" {
 			fatalln("No name: New repos must be given a name")
@@ -235,7 +282,7 @@ func collaborators(opts Options) {
 
 		users, _, err := client.Repositories.ListCollaborators(ctx, Owner,
 			opts.CommonOpts.Name,
-			&github.ListCollaboratorsOptions{
+			&gh.ListCollaboratorsOptions{
 				Affiliation: "all",
 			})
 
@@ -273,35 +320,37 @@ func deployKey(opts Options) {
 	if opts.CommandOpts.Create {
 		options := opts.DevKeyOpts
 
-		if !options.ReadOnly {
-			fmt.Println("必须开启 --read-only 此项才是最安全的")
-			options.ReadOnly = true
-		}
-
 		if opts.CommonOpts.Name == "" {
 			fatalln("No name: New repos must be given a name")
 		}
 
-		if _, ok := os.Stat(options.Key); ok == nil {
+		if options.Key == "" {
+			repo, ok := utils.GetRepo(opts.CommonOpts.Name)
+			if !ok {
+				fatalln("请使用 --key 指定公钥")
+			}
+
+			pub, err := github.ReadPublicKey(repo)
+			if err != nil {
+				fatalln(err)
+			}
+			options.Key = github.AuthorizedKey(pub)
+		} else if _, ok := os.Stat(options.Key); ok == nil {
 			tmpKey, err := ioutil.ReadFile(options.Key)
 			if err == nil {
 				options.Key = string(tmpKey)
 			}
 		}
 
-		key, _, err := client.Repositories.CreateKey(ctx, Owner,
-			opts.CommonOpts.Name,
-			&github.Key{
-				Key:      &options.Key,
-				Title:    &options.Title,
-				ReadOnly: &options.ReadOnly,
-			})
+		options.Title = DefaultValues(options.Title, "code-get@"+opts.CommonOpts.Name)
+
+		key, err := CreateDeployKey(client, ctx, Owner, opts.CommonOpts.Name, options.Title, options.Key)
 
 		if err != nil {
 			fatalln(err)
 		}
 
-		fmt.Printf("key[%d] %s install ok\n", + key.GetID(), key.GetTitle())
+		fmt.Printf("key[%d] %s install ok\n", key.GetID(), key.GetTitle())
 	} else if opts.CommandOpts.List {
 
 		if opts.CommonOpts.Name == "" {
@@ -310,7 +359,7 @@ func deployKey(opts Options) {
 
 		keys, _, err := client.Repositories.ListKeys(ctx, Owner,
 			opts.CommonOpts.Name,
-			&github.ListOptions{},
+			&gh.ListOptions{},
 		)
 
 		if err != nil {
@@ -346,26 +395,22 @@ func webHook(opts Options) {
 	}
 
 	if opts.CommandOpts.Create {
-		active := true
-		hookInfo := github.Hook{
-			Config: map[string]interface{}{
-				"url":          "http://" + opts.WebHookOpts.Ip + ":17293",
-				"content_type": "json",
-				"secret":       Secret,
-				"insecure_ssl": "0",
-			},
-			Events: []string{"push"},
-			Active: &active,
+		url, err := HookURL(opts.WebHookOpts.Ip)
+		if err != nil {
+			fatalln(err)
 		}
-		hook, _, err := client.Repositories.CreateHook(ctx, Owner, opts.CommonOpts.Name, &hookInfo)
+
+		// 未配置的项目按默认配置只订阅 push
+		repo, _ := utils.GetRepo(opts.CommonOpts.Name)
+		hook, err := CreateWebHook(client, ctx, Owner, opts.CommonOpts.Name, url, Secret, github.HookEvents(repo))
 
 		if err != nil {
 			fatalln(err)
 		}
 
-		fmt.Println("hook 安装: " + strconv.FormatBool(*hook.Active))
+		fmt.Println("hook 安装: " + strconv.FormatBool(hook.GetActive()))
 	} else if opts.CommandOpts.List {
-		hooks, _, err := client.Repositories.ListHooks(ctx, Owner, opts.CommonOpts.Name, &github.ListOptions{})
+		hooks, _, err := client.Repositories.ListHooks(ctx, Owner, opts.CommonOpts.Name, &gh.ListOptions{})
 		if err != nil {
 			fatalln(err)
 		}
@@ -0,0 +1,270 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/xiaosumay/server-code-mgr/github"
+	"github.com/xiaosumay/server-code-mgr/utils"
+)
+
+const testPublicURL = "https://deploy.example.com/hook"
+
+type apiRequest struct {
+	Method string
+	Path   string
+	Auth   string
+	Body   map[string]interface{}
+}
+
+// fakeGitHub 是 GitHub API 的替身，记录收到的请求并返回固定的结果
+type fakeGitHub struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []apiRequest
+}
+
+func newFakeGitHub(t *testing.T) *fakeGitHub {
+	t.Helper()
+
+	f := &fakeGitHub{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := apiRequest{Method: r.Method, Path: r.URL.Path, Auth: r.Header.Get("Authorization")}
+		if data, _ := ioutil.ReadAll(r.Body); len(data) != 0 {
+			if err := json.Unmarshal(data, &req.Body); err != nil {
+				t.Errorf("%s %s 的请求不是 JSON: %s", r.Method, r.URL.Path, data)
+			}
+		}
+
+		f.mu.Lock()
+		f.requests = append(f.requests, req)
+		f.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && r.URL.Path == "/repos/acme/site/hooks":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id":9,"active":true}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/repos/acme/site/keys":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id":7,"title":"code-get@site","read_only":true}`)
+		case r.URL.Path == "/repos/acme/site/hooks":
+			fmt.Fprintf(w, `[{"id":9,"config":{"url":%q}}]`, testPublicURL)
+		case r.URL.Path == "/repos/acme/site/keys":
+			fmt.Fprint(w, `[{"id":7,"title":"code-get@site"}]`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"Not Found"}`)
+		}
+	}))
+
+	return f
+}
+
+func (f *fakeGitHub) take() []apiRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	list := f.requests
+	f.requests = nil
+	return list
+}
+
+// writeConfig 在 dir 中写一份让 api_url 指向 f 的配置文件并加载
+func writeConfig(t *testing.T, f *fakeGitHub, dir string) string {
+	t.Helper()
+
+	config := filepath.Join(dir, "repositories.conf")
+	data := fmt.Sprintf("api_url = %s/\npublic_url = %s\nhtml_dir = %s\n\n[site]\nowner = acme\nsecret = s3cret\n",
+		f.URL, testPublicURL, dir)
+	if err := ioutil.WriteFile(config, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	utils.ParseConfig(config)
+	return config
+}
+
+// setup 启动 GitHub API 的替身并加载指向它的配置，测试结束时调用返回的函数清理
+func setup(t *testing.T) (*fakeGitHub, string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "code-get-admin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFakeGitHub(t)
+	config := writeConfig(t, f, dir)
+
+	return f, config, func() {
+		f.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCreateWebHook(t *testing.T) {
+	f, _, cleanup := setup(t)
+	defer cleanup()
+
+	url, err := HookURL("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != testPublicURL {
+		t.Errorf("HookURL() = %s，应为 public_url %s", url, testPublicURL)
+	}
+
+	client, ctx, err := github.NewClient("tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, _ := utils.GetRepo("site")
+	events := []string{"push", "pull_request"}
+	if _, err := CreateWebHook(client, ctx, "acme", "site", url, repo.Secret, events); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := f.take()
+	if len(requests) != 1 || requests[0].Method != http.MethodPost || requests[0].Path != "/repos/acme/site/hooks" {
+		t.Fatalf("请求不正确: %+v", requests)
+	}
+
+	req := requests[0]
+	if req.Auth != "Bearer tok" {
+		t.Errorf("Authorization = %q", req.Auth)
+	}
+
+	want := map[string]interface{}{
+		"url":          testPublicURL,
+		"content_type": "json",
+		"secret":       "s3cret",
+		"insecure_ssl": "0",
+	}
+	if !reflect.DeepEqual(req.Body["config"], want) {
+		t.Errorf("config = %v，应为 %v", req.Body["config"], want)
+	}
+	if !reflect.DeepEqual(req.Body["events"], []interface{}{"push", "pull_request"}) {
+		t.Errorf("events = %v", req.Body["events"])
+	}
+	if req.Body["name"] != "web" || req.Body["active"] != true {
+		t.Errorf("name = %v, active = %v", req.Body["name"], req.Body["active"])
+	}
+}
+
+func TestCreateWebHookWithoutSecret(t *testing.T) {
+	f, _, cleanup := setup(t)
+	defer cleanup()
+
+	client, ctx, err := github.NewClient("tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CreateWebHook(client, ctx, "acme", "site", testPublicURL, "", []string{"push"}); err == nil {
+		t.Error("没有 secret 时应该返回错误")
+	}
+	if requests := f.take(); len(requests) != 0 {
+		t.Errorf("没有 secret 时不应访问 API: %+v", requests)
+	}
+}
+
+func TestHookURLWithIP(t *testing.T) {
+	url, err := HookURL("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "http://10.0.0.1:17293" {
+		t.Errorf("HookURL(10.0.0.1) = %s", url)
+	}
+}
+
+func TestCreateDeployKey(t *testing.T) {
+	f, _, cleanup := setup(t)
+	defer cleanup()
+
+	client, ctx, err := github.NewClient("tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := CreateDeployKey(client, ctx, "acme", "site", "code-get@site", "ssh-ed25519 AAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.GetID() != 7 {
+		t.Errorf("key id = %d", key.GetID())
+	}
+
+	requests := f.take()
+	if len(requests) != 1 || requests[0].Path != "/repos/acme/site/keys" {
+		t.Fatalf("请求不正确: %+v", requests)
+	}
+
+	want := map[string]interface{}{
+		"key":       "ssh-ed25519 AAAA",
+		"title":     "code-get@site",
+		"read_only": true,
+	}
+	if !reflect.DeepEqual(requests[0].Body, want) {
+		t.Errorf("请求内容 = %v，应为 %v", requests[0].Body, want)
+	}
+}
+
+func TestRun(t *testing.T) {
+	f, config, cleanup := setup(t)
+	defer cleanup()
+
+	tests := []struct {
+		args   []string
+		method string
+		path   string
+	}{
+		{[]string{"--hook", "-a"}, http.MethodPost, "/repos/acme/site/hooks"},
+		{[]string{"--hook", "-l"}, http.MethodGet, "/repos/acme/site/hooks"},
+		{[]string{"--hook", "-d", "--hook-id", "9"}, http.MethodDelete, "/repos/acme/site/hooks/9"},
+		{[]string{"--deploy", "-a", "--key", "ssh-ed25519 AAAA"}, http.MethodPost, "/repos/acme/site/keys"},
+		{[]string{"--deploy", "-l"}, http.MethodGet, "/repos/acme/site/keys"},
+		{[]string{"--deploy", "-d", "--deploy-id", "7"}, http.MethodDelete, "/repos/acme/site/keys/7"},
+	}
+
+	for _, test := range tests {
+		args := append([]string{"-c", config, "--token", "tok", "--name", "site"}, test.args...)
+		if code := Run(args); code != 0 {
+			t.Errorf("Run(%v) = %d", test.args, code)
+			continue
+		}
+
+		requests := f.take()
+		if len(requests) != 1 || requests[0].Method != test.method || requests[0].Path != test.path {
+			t.Errorf("Run(%v) 的请求 = %+v，应为 %s %s", test.args, requests, test.method, test.path)
+			continue
+		}
+
+		// 创建钩子时使用配置中项目的 secret 和 public_url
+		if test.method == http.MethodPost && test.path == "/repos/acme/site/hooks" {
+			config := requests[0].Body["config"].(map[string]interface{})
+			if config["secret"] != "s3cret" || config["url"] != testPublicURL {
+				t.Errorf("钩子配置 = %v", config)
+			}
+			if !reflect.DeepEqual(requests[0].Body["events"], []interface{}{"push"}) {
+				t.Errorf("钩子订阅的事件 = %v", requests[0].Body["events"])
+			}
+		}
+		if test.method == http.MethodPost && test.path == "/repos/acme/site/keys" && requests[0].Body["read_only"] != true {
+			t.Errorf("部署 key 应为只读: %v", requests[0].Body)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/xiaosumay/server-code-mgr/utils"
+)
+
+func configUsage() {
+	fmt.Fprintln(os.Stderr, "用法: code-get config check [-c 配置文件] [--json]")
+	fmt.Fprintln(os.Stderr, "      code-get config convert [-c 配置文件] [-o 输出文件]")
+}
+
+// configCommand 处理 config 子命令，返回进程退出码
+func configCommand(args []string) int {
+	if len(args) == 0 {
+		configUsage()
+		return 2
+	}
+
+	switch args[0] {
+	case "check":
+		fs := newFlagSet("config check", "config check [-c 配置文件] [--json]",
+			"检查配置文件：未知的配置项、类型错误、extends 和 include 的问题等。发现问题时退出码为 1。")
+		path := fs.String("c", defaultConfig, "配置文件")
+		jsonOutput := fs.Bool("json", false, "以 JSON 格式输出发现的问题")
+		if err := fs.Parse(args[1:]); err != nil {
+			return flagError(err)
+		}
+		if fs.NArg() != 0 {
+			fs.Usage()
+			return 2
+		}
+		if _, err := os.Stat(*path); err != nil {
+			fmt.Fprintf(os.Stderr, "请提供配置文件: %v\n", err)
+			return 2
+		}
+
+		problems := utils.CheckConfig(*path)
+
+		if *jsonOutput {
+			if problems == nil {
+				problems = []utils.ConfigError{}
+			}
+			printJSON(struct {
+				Config   string              `json:"config"`
+				Problems []utils.ConfigError `json:"problems"`
+			}{*path, problems})
+
+			if len(problems) != 0 {
+				return 1
+			}
+			return 0
+		}
+
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", *path, problem)
+		}
+
+		if len(problems) != 0 {
+			fmt.Printf("发现 %d 个问题\n", len(problems))
+			return 1
+		}
+
+		fmt.Println("配置正确")
+		return 0
+	case "convert":
+		fs := newFlagSet("config convert", "config convert [-c 配置文件] [-o 输出文件]",
+			"把 INI 格式的配置文件转换为 YAML 格式，输出文件沿用原配置文件的权限。")
+		path := fs.String("c", defaultConfig, "INI 格式的配置文件")
+		output := fs.String("o", "", "输出的 YAML 文件，默认输出到标准输出")
+		if err := fs.Parse(args[1:]); err != nil {
+			return flagError(err)
+		}
+		if fs.NArg() != 0 {
+			fs.Usage()
+			return 2
+		}
+		if _, err := os.Stat(*path); err != nil {
+			fmt.Fprintf(os.Stderr, "请提供配置文件: %v\n", err)
+			return 2
+		}
+
+		data, err := utils.ConvertConfig(*path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		if *output == "" {
+			os.Stdout.Write(data)
+			return 0
+		}
+
+		// 配置中有各项目的 secret，输出文件沿用原配置文件的权限
+		mode := os.FileMode(0600)
+		if info, err := os.Stat(*path); err == nil {
+			mode = info.Mode().Perm()
+		}
+
+		if err := ioutil.WriteFile(*output, data, mode); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		// 覆盖已存在的文件时 WriteFile 不会修改权限
+		if err := os.Chmod(*output, mode); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	default:
+		configUsage()
+		return 2
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/xiaosumay/server-code-mgr/github"
+	"github.com/xiaosumay/server-code-mgr/utils"
+)
+
+// shortHash 返回提交的前 8 位，便于在表格中显示
+func shortHash(hash string) string {
+	// release 部署的项目记录的是标签，不截断
+	if len(hash) == 40 {
+		return hash[:8]
+	}
+	if len(hash) == 0 {
+		return "-"
+	}
+	return hash
+}
+
+// selectRepos 按名称或通配符（如 api-*）选出项目，不指定时返回所有项目，
+// 同一个项目只出现一次
+func selectRepos(patterns []string) ([]string, error) {
+	repos := utils.Repositories()
+
+	var all []string
+	for name := range repos {
+		all = append(all, name)
+	}
+	sort.Strings(all)
+
+	if len(patterns) == 0 {
+		return all, nil
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		matched := false
+		for _, name := range all {
+			ok, err := path.Match(pattern, name)
+			if err != nil {
+				return nil, fmt.Errorf("通配符 %s 不合法: %v", pattern, err)
+			}
+			if !ok {
+				continue
+			}
+
+			matched = true
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+
+		if !matched {
+			return nil, fmt.Errorf("没有与 %s 匹配的项目", pattern)
+		}
+	}
+
+	return names, nil
+}
+
+// deployAll 最多同时部署 jobs 个项目，结果与 names 的顺序一致。
+// force 表示同样部署被改写的历史（allow_force = false 的项目）
+func deployAll(names []string, jobs int, force bool) []github.Deployment {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	list := make([]github.Deployment, len(names))
+	queue := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < jobs && i < len(names); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				repo, _ := utils.GetRepo(names[i])
+				list[i] = github.Deploy(names[i], repo, github.Request{Force: force})
+			}
+		}()
+	}
+
+	for i := range names {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	return list
+}
+
+// printSummary 输出每个项目的部署结果和耗时，以及总计
+func printSummary(list []github.Deployment, elapsed time.Duration) {
+	counts := make(map[string]int)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "项目\t结果\t版本\t耗时\t错误")
+	for _, d := range list {
+		counts[d.Status]++
+		fmt.Fprintf(w, "%s\t%s\t%s -> %s\t%.1fs\t%s\n",
+			d.Repo, d.Status, shortHash(d.Before), shortHash(d.After), d.Duration, d.Error)
+	}
+	w.Flush()
+
+	fmt.Printf("共 %d 个项目: 成功 %d，未变化 %d，失败 %d，拒绝 %d，耗时 %.1fs\n",
+		len(list), counts[github.StatusSuccess], counts[github.StatusUnchanged], counts[github.StatusFailed],
+		counts[github.StatusRefused], elapsed.Seconds())
+}
+
+func printDeployments(list []github.Deployment) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\t项目\t操作\t状态\t版本\t耗时\t错误")
+	for _, d := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s -> %s\t%.1fs\t%s\n",
+			d.ID, d.Repo, d.Action, d.Status, shortHash(d.Before), shortHash(d.After), d.Duration, d.Error)
+	}
+	w.Flush()
+}
+
+func deployCommand(args []string) int {
+	fs := newFlagSet("deploy", "deploy [-c 配置文件] [-j 并发数] [-force] [--json] [项目名|通配符...]",
+		"部署项目的最新提交，项目可以用通配符（如 'api-*'）选择，不指定时部署所有项目。\n任何一个项目部署失败或被拒绝时退出码为 1。")
+	configPath := fs.String("c", defaultConfig, "配置文件")
+	jobs := fs.Int("j", 4, "同时部署的项目数")
+	force := fs.Bool("force", false, "分支历史被改写时同样部署（忽略 allow_force = false）")
+	jsonOutput := fs.Bool("json", false, "以 JSON 格式输出部署结果")
+	if err := fs.Parse(args); err != nil {
+		return flagError(err)
+	}
+
+	if !loadConfig(*configPath) {
+		return 2
+	}
+
+	names, err := selectRepos(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	start := time.Now()
+	list := deployAll(names, *jobs, *force)
+
+	if *jsonOutput {
+		printJSON(list)
+	} else {
+		printSummary(list, time.Since(start))
+	}
+
+	for _, d := range list {
+		if d.Status == github.StatusFailed || d.Status == github.StatusRefused {
+			return 1
+		}
+	}
+	return 0
+}
+
+func rollbackCommand(args []string) int {
+	fs := newFlagSet("rollback", "rollback [-c 配置文件] [--json] <项目名> [部署ID|提交]",
+		"把项目切换回之前部署的版本并重新执行部署步骤。不指定版本时回到当前版本之前最近一次部署成功的版本。")
+	configPath := fs.String("c", defaultConfig, "配置文件")
+	jsonOutput := fs.Bool("json", false, "以 JSON 格式输出部署结果")
+	if err := fs.Parse(args); err != nil {
+		return flagError(err)
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	if !loadConfig(*configPath) {
+		return 2
+	}
+
+	name := fs.Arg(0)
+	repo, ok := utils.GetRepo(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "项目 %s 不在配置中\n", name)
+		return 2
+	}
+
+	d, err := github.Rollback(name, repo, fs.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *jsonOutput {
+		printJSON(d)
+	} else {
+		printDeployments([]github.Deployment{d})
+	}
+
+	if d.Status == github.StatusFailed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,257 @@
+package github
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+const (
+	authKey   = "key"
+	authAgent = "agent"
+	authToken = "token"
+	authBasic = "basic"
+
+	defaultTokenUser = "x-access-token"
+)
+
+// httpCredential 返回 https 远程仓库的用户名和令牌，令牌只从文件读取，不出现在配置和日志中
+func httpCredential(rep Repo) (string, string, error) {
+	user := rep.HttpUser
+	if rep.Auth == authToken {
+		user = DefaultValue(user, defaultTokenUser)
+	}
+	if len(user) == 0 {
+		return "", "", fmt.Errorf("auth = basic 需要配置 http_user")
+	}
+
+	if len(rep.TokenFile) == 0 {
+		return "", "", fmt.Errorf("auth = %s 需要配置 token_file", rep.Auth)
+	}
+
+	data, err := ioutil.ReadFile(rep.TokenFile)
+	if err != nil {
+		return "", "", fmt.Errorf("读取令牌失败: %v", err)
+	}
+
+	return user, string(bytes.TrimSpace(data)), nil
+}
+
+func keyPassphrase(rep Repo) ([]byte, error) {
+	if len(rep.KeyPassphraseFile) == 0 {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(rep.KeyPassphraseFile)
+	if err != nil {
+		return nil, fmt.Errorf("读取私钥密码失败: %v", err)
+	}
+
+	return bytes.TrimRight(data, "\r\n"), nil
+}
+
+// loadPrivateKey 读取项目配置的私钥，配置了 key_passphrase_file 时先解密
+func loadPrivateKey(rep Repo) (interface{}, error) {
+	data, err := ioutil.ReadFile(KeyPath(rep.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	passphrase, err := keyPassphrase(rep)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parsePrivateKey(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("私钥 %s 解析失败: %v", KeyPath(rep.Key), err)
+	}
+
+	return key, nil
+}
+
+func getAuth(rep Repo) (transport.AuthMethod, error) {
+	switch rep.Auth {
+	case authToken, authBasic:
+		user, token, err := httpCredential(rep)
+		if err != nil {
+			return nil, err
+		}
+
+		return &githttp.BasicAuth{Username: user, Password: token}, nil
+	}
+
+	callback, err := hostKeyCallback(rep)
+	if err != nil {
+		return nil, err
+	}
+
+	switch DefaultValue(rep.Auth, authKey) {
+	case authAgent:
+		auth, err := gitssh.NewSSHAgentAuth(gitssh.DefaultUsername)
+		if err != nil {
+			return nil, fmt.Errorf("无法连接 ssh-agent: %v", err)
+		}
+		auth.HostKeyCallback = callback
+
+		return auth, nil
+	case authKey:
+		key, err := loadPrivateKey(rep)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		auth := &gitssh.PublicKeys{
+			User:   gitssh.DefaultUsername,
+			Signer: signer,
+		}
+		auth.HostKeyCallback = callback
+
+		return auth, nil
+	default:
+		return nil, fmt.Errorf("不支持的认证方式 %s", rep.Auth)
+	}
+}
+
+// askPassScript 生成给 GIT_ASKPASS 使用的脚本，脚本执行时才读取令牌文件，
+// 令牌不会出现在环境变量和日志中
+func askPassScript(rep Repo) (string, error) {
+	user, _, err := httpCredential(rep)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile("", "code-get-askpass-")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = fmt.Fprintf(f, "#!/bin/sh\ncase \"$1\" in\nUsername*) echo %s ;;\n*) cat %s ;;\nesac\n",
+		Quote(user), Quote(rep.TokenFile))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0700)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// keyAgent 在私有临时目录中启动一个只包含 key 的 ssh-agent，返回它的 socket 和公钥文件。
+// 解密后的私钥只保存在内存中，命令结束后调用 stop 关闭
+func keyAgent(key interface{}) (string, string, func(), error) {
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "code-get-agent-")
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	// ssh 通过公钥文件从 agent 中选出这个私钥，配合 IdentitiesOnly 不会尝试其他私钥
+	pubFile := filepath.Join(dir, "key.pub")
+	if err := ioutil.WriteFile(pubFile, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", "", nil, err
+	}
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		os.RemoveAll(dir)
+		return "", "", nil, err
+	}
+
+	sock := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", "", nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	stop := func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+
+	return sock, pubFile, stop, nil
+}
+
+// gitCredentialEnv 返回让脚本中的 git 使用与 go-git 相同凭据的环境变量。
+// 加密的私钥解密后交给临时的 ssh-agent，不会写入磁盘，命令结束后调用 cleanup 关闭。
+func gitCredentialEnv(rep Repo) ([]string, func(), error) {
+	cleanup := func() {}
+	command := "ssh " + sshHostOptions(rep)
+
+	switch DefaultValue(rep.Auth, authKey) {
+	case authToken, authBasic:
+		script, err := askPassScript(rep)
+		if err != nil {
+			return nil, cleanup, err
+		}
+
+		return []string{"GIT_ASKPASS=" + script, "GIT_TERMINAL_PROMPT=0"}, func() { os.Remove(script) }, nil
+	case authAgent:
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if len(sock) == 0 {
+			return nil, cleanup, fmt.Errorf("无法连接 ssh-agent: SSH_AUTH_SOCK 未设置")
+		}
+
+		return []string{"GIT_SSH_COMMAND=" + command, "SSH_AUTH_SOCK=" + sock}, cleanup, nil
+	case authKey:
+		if len(rep.KeyPassphraseFile) == 0 {
+			command += " -o IdentitiesOnly=yes -i " + Quote(KeyPath(rep.Key))
+			return []string{"GIT_SSH_COMMAND=" + command}, cleanup, nil
+		}
+
+		key, err := loadPrivateKey(rep)
+		if err != nil {
+			return nil, cleanup, err
+		}
+
+		sock, pubFile, stop, err := keyAgent(key)
+		if err != nil {
+			return nil, cleanup, err
+		}
+
+		command += " -o IdentitiesOnly=yes -i " + Quote(pubFile)
+
+		return []string{"GIT_SSH_COMMAND=" + command, "SSH_AUTH_SOCK=" + sock}, stop, nil
+	default:
+		return nil, cleanup, fmt.Errorf("不支持的认证方式 %s", rep.Auth)
+	}
+}
@@ -0,0 +1,78 @@
+package github
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func envValue(env []string, name string) string {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			return strings.TrimPrefix(kv, name+"=")
+		}
+	}
+	return ""
+}
+
+func TestGitCredentialEnvEncryptedKey(t *testing.T) {
+	key, _ := filepath.Abs(filepath.Join("testdata", "ed25519_encrypted"))
+	passphrase, _ := filepath.Abs(filepath.Join("testdata", "passphrase"))
+
+	env, cleanup, err := gitCredentialEnv(Repo{Key: key, KeyPassphraseFile: passphrase})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := envValue(env, "SSH_AUTH_SOCK")
+	if len(sock) == 0 {
+		cleanup()
+		t.Fatalf("没有设置 SSH_AUTH_SOCK: %v", env)
+	}
+	dir := filepath.Dir(sock)
+
+	// 临时目录中只能有 socket 和公钥，不能有解密后的私钥
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Mode().IsRegular() {
+			data, _ := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+			if strings.Contains(string(data), "PRIVATE KEY") {
+				t.Errorf("%s 中包含私钥", f.Name())
+			}
+		}
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := agent.NewClient(conn).List()
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := authorizedKey(readTestdata(t, "ed25519_encrypted.pub"))
+	if len(keys) != 1 || authorizedKey([]byte(keys[0].String())) != want {
+		t.Errorf("agent 中的私钥是 %v，应为 %s", keys, want)
+	}
+
+	command := envValue(env, "GIT_SSH_COMMAND")
+	if !strings.Contains(command, "IdentitiesOnly=yes") || !strings.Contains(command, filepath.Join(dir, "key.pub")) {
+		t.Errorf("GIT_SSH_COMMAND 没有指定公钥: %s", command)
+	}
+
+	cleanup()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("cleanup 后 %s 仍然存在", dir)
+	}
+}
@@ -0,0 +1,57 @@
+package github
+
+import (
+	"log"
+	"time"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+)
+
+// branchDeleted 处理部署分支被删除的推送：不再部署，配置了 on_branch_deleted 时执行它
+func branchDeleted(repoName string, rep Repo) {
+	log.Printf("项目 %s 的分支 %s 已被删除，保留当前部署\n", repoName, rep.Branch)
+
+	if len(rep.OnBranchDeleted) == 0 {
+		return
+	}
+
+	go func() {
+		lock := repoLock(repoName)
+		lock.Lock()
+		defer lock.Unlock()
+
+		if err := runHook(repoName, rep, "on_branch_deleted", rep.OnBranchDeleted); err != nil {
+			log.Printf("项目 %s: %v\n", repoName, err)
+		}
+	}()
+}
+
+// forcePushed 把被改写的历史记录到部署历史，allow_force = false 时不部署
+func forcePushed(repoName string, rep Repo, before, after string) {
+	start := time.Now()
+	d := Deployment{
+		ID:     start.Format("20060102-150405.000"),
+		Repo:   repoName,
+		Branch: rep.Branch,
+		Action: ActionForcePush,
+		Before: before,
+		After:  after,
+		Status: StatusAccepted,
+		Start:  start,
+	}
+
+	if !rep.AllowForce {
+		d.Status = StatusRefused
+		d.Error = "allow_force = false，不部署强制推送"
+	}
+
+	log.Printf("项目 %s 的分支 %s 被强制推送: %s -> %s (%s)\n", repoName, rep.Branch, before, after, d.Status)
+
+	if err := appendHistory(d); err != nil {
+		log.Println(err)
+	}
+
+	if rep.AllowForce {
+		Submit(repoName, rep, Request{Commit: after, Force: true})
+	}
+}
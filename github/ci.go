@@ -0,0 +1,418 @@
+package github
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gh "github.com/google/go-github/github"
+	. "github.com/xiaosumay/server-code-mgr/utils"
+)
+
+const (
+	ActionCI      = "ci"
+	StatusTimeout = "timeout"
+)
+
+// PendingDeploy 是等待 CI 通过的部署，保存在 state_dir/pending.json 中
+type PendingDeploy struct {
+	Repo   string    `json:"repo"`
+	Commit string    `json:"commit"`
+	Force  bool      `json:"force,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+type ciPayload struct {
+	// status 事件
+	SHA string `json:"sha"`
+
+	// check_suite 和 workflow_run 事件
+	Action     string `json:"action"`
+	CheckSuite struct {
+		HeadSHA string `json:"head_sha"`
+	} `json:"check_suite"`
+	WorkflowRun struct {
+		HeadSHA string `json:"head_sha"`
+	} `json:"workflow_run"`
+
+	Repository struct {
+		Name string `json:"name"`
+	} `json:"repository"`
+}
+
+const (
+	ciSuccess = "success"
+	ciFailure = "failure"
+	ciPending = "pending"
+)
+
+// ciFailures 是表示 CI 失败的 state 和 conclusion
+var ciFailures = map[string]bool{
+	"failure":         true,
+	"error":           true,
+	"cancelled":       true,
+	"timed_out":       true,
+	"action_required": true,
+}
+
+var (
+	ciLock sync.Mutex
+	// waiting 是每个项目等待 CI 的部署，同一个项目只保留最新的一次推送
+	waiting map[string]PendingDeploy
+)
+
+func pendingFile() string {
+	return filepath.Join(GetSettings().StateDir, "pending.json")
+}
+
+// PendingDeploys 返回等待 CI 通过的部署，按项目名排序
+func PendingDeploys() ([]PendingDeploy, error) {
+	var list []PendingDeploy
+
+	data, err := ioutil.ReadFile(pendingFile())
+	if os.IsNotExist(err) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Repo < list[j].Repo
+	})
+	return list, nil
+}
+
+// loadWaiting 在第一次使用时读取上次运行留下的等待列表，调用时需持有 ciLock
+func loadWaiting() {
+	if waiting != nil {
+		return
+	}
+	waiting = make(map[string]PendingDeploy)
+
+	list, err := PendingDeploys()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, p := range list {
+		waiting[p.Repo] = p
+	}
+}
+
+// saveWaiting 保存等待列表，调用时需持有 ciLock
+func saveWaiting() {
+	list := make([]PendingDeploy, 0, len(waiting))
+	for _, p := range waiting {
+		list = append(list, p)
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(pendingFile()), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(pendingFile(), data, 0644)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// recordCI 把没有部署的推送记录到部署历史
+func recordCI(rep Repo, p PendingDeploy, status, reason string) {
+	start := time.Now()
+	d := Deployment{
+		ID:     start.Format("20060102-150405.000"),
+		Repo:   p.Repo,
+		Branch: rep.Branch,
+		Action: ActionCI,
+		After:  p.Commit,
+		Status: status,
+		Error:  reason,
+		Start:  start,
+	}
+
+	if err := appendHistory(d); err != nil {
+		log.Println(err)
+	}
+}
+
+// Submit 请求部署项目，配置了 require_ci 时等待同一提交的 CI 通过后再部署
+func Submit(repoName string, rep Repo, req Request) {
+	if !rep.RequireCI || len(req.Commit) == 0 {
+		Enqueue(repoName, req)
+		return
+	}
+
+	ciLock.Lock()
+	loadWaiting()
+
+	if old, ok := waiting[repoName]; ok && old.Commit != req.Commit {
+		log.Printf("项目 %s 的提交 %s 被新的推送取代，不再等待 CI\n", repoName, old.Commit)
+	}
+
+	p := PendingDeploy{
+		Repo:   repoName,
+		Commit: req.Commit,
+		Force:  req.Force,
+		Since:  time.Now(),
+	}
+	waiting[repoName] = p
+	saveWaiting()
+	ciLock.Unlock()
+
+	log.Printf("项目 %s 的提交 %s 等待 CI 通过后部署\n", repoName, req.Commit)
+
+	// CI 可能在推送到达之前就已经完成
+	go checkCI(repoName, rep, p)
+}
+
+// ciChecks 通过 API 读取提交的全部 commit status 和 check run，返回名称到结果（success、failure 或 pending）的对应。
+// 部署服务自己报告的 code-get/deploy 不算在内
+func ciChecks(repoName string, rep Repo, sha string) (map[string]string, error) {
+	token, err := APIToken("")
+	if err != nil {
+		return nil, err
+	}
+
+	client, ctx, err := NewClient(token)
+	if err != nil {
+		return nil, err
+	}
+
+	checks := make(map[string]string)
+
+	opt := &gh.ListOptions{PerPage: 100}
+	for {
+		combined, resp, err := client.Repositories.GetCombinedStatus(ctx, rep.Owner, repoName, sha, opt)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, status := range combined.Statuses {
+			switch state := status.GetState(); {
+			case state == "success":
+				checks[status.GetContext()] = ciSuccess
+			case ciFailures[state]:
+				checks[status.GetContext()] = ciFailure
+			default:
+				checks[status.GetContext()] = ciPending
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	runOpt := &gh.ListCheckRunsOptions{ListOptions: gh.ListOptions{PerPage: 100}}
+	for {
+		runs, resp, err := client.Checks.ListCheckRunsForRef(ctx, rep.Owner, repoName, sha, runOpt)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, run := range runs.CheckRuns {
+			result := ciPending
+			if run.GetStatus() == "completed" {
+				switch conclusion := run.GetConclusion(); {
+				case ciFailures[conclusion]:
+					result = ciFailure
+				case conclusion == "success", conclusion == "neutral", conclusion == "skipped":
+					result = ciSuccess
+				}
+			}
+
+			// 同名的 check run 有一个失败即为失败
+			if checks[run.GetName()] != ciFailure {
+				checks[run.GetName()] = result
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		runOpt.Page = resp.NextPage
+	}
+
+	delete(checks, StatusContext)
+	return checks, nil
+}
+
+// ciResult 汇总提交的 CI 结果。配置了 ci_contexts 时只看其中列出的检查，全部成功才算通过；
+// 否则所有检查都成功才算通过，还没有任何检查时继续等待
+func ciResult(rep Repo, checks map[string]string) (string, string) {
+	names := make([]string, 0, len(checks))
+	if len(rep.CIContexts) != 0 {
+		for _, name := range rep.CIContexts {
+			names = append(names, strings.TrimSpace(name))
+		}
+	} else {
+		for name := range checks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	if len(names) == 0 {
+		return ciPending, "还没有 CI 结果"
+	}
+
+	result, reason := ciSuccess, ""
+	for _, name := range names {
+		switch checks[name] {
+		case ciFailure:
+			return ciFailure, name + " 未通过"
+		case ciSuccess:
+		default:
+			result, reason = ciPending, "等待 "+name
+		}
+	}
+
+	return result, reason
+}
+
+// checkCI 查询等待中的提交的 CI 结果，全部通过时部署，有检查失败时放弃部署
+func checkCI(repoName string, rep Repo, p PendingDeploy) {
+	checks, err := ciChecks(repoName, rep, p.Commit)
+	if err != nil {
+		log.Printf("项目 %s 查询提交 %s 的 CI 结果失败: %v\n", repoName, p.Commit, err)
+		return
+	}
+
+	result, reason := ciResult(rep, checks)
+	if result == ciPending {
+		log.Printf("项目 %s 的提交 %s %s\n", repoName, p.Commit, reason)
+		return
+	}
+
+	ciLock.Lock()
+	defer ciLock.Unlock()
+	loadWaiting()
+
+	// 查询期间可能已经被新的推送取代或被其他事件处理
+	if current, ok := waiting[repoName]; !ok || current.Commit != p.Commit {
+		return
+	}
+	delete(waiting, repoName)
+	saveWaiting()
+
+	if result == ciFailure {
+		recordCI(rep, p, StatusFailed, "CI "+reason)
+		log.Printf("项目 %s 的提交 %s CI %s，不部署\n", repoName, p.Commit, reason)
+		return
+	}
+
+	log.Printf("项目 %s 的提交 %s CI 已通过\n", repoName, p.Commit)
+	Enqueue(repoName, Request{Commit: p.Commit, Force: p.Force})
+}
+
+// CIEvent 处理 status、check_suite 和 workflow_run 事件。事件只用来触发检查，
+// 是否部署由 checkCI 查询到的该提交全部的 CI 结果决定
+func CIEvent(event string, data []byte) bool {
+	var payload ciPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		log.Println(err)
+		return false
+	}
+
+	var sha string
+	switch event {
+	case "status":
+		sha = payload.SHA
+	case "check_suite":
+		sha = payload.CheckSuite.HeadSHA
+	case "workflow_run":
+		sha = payload.WorkflowRun.HeadSHA
+	}
+
+	// 未完成的检查没有结论
+	if event != "status" && payload.Action != "completed" {
+		return true
+	}
+
+	repoName := payload.Repository.Name
+	rep, ok := GetRepo(repoName)
+	if !ok || !rep.RequireCI {
+		return true
+	}
+
+	ciLock.Lock()
+	loadWaiting()
+	p, ok := waiting[repoName]
+	ciLock.Unlock()
+
+	if ok && p.Commit == sha {
+		go checkCI(repoName, rep, p)
+	}
+
+	return true
+}
+
+// expireWaiting 放弃等待超过 ci_timeout 的部署
+func expireWaiting() {
+	ciLock.Lock()
+	defer ciLock.Unlock()
+	loadWaiting()
+
+	changed := false
+	for repoName, p := range waiting {
+		rep, ok := GetRepo(repoName)
+		if !ok || !rep.RequireCI {
+			delete(waiting, repoName)
+			changed = true
+			continue
+		}
+
+		if rep.CITimeout > 0 && time.Since(p.Since) > rep.CITimeout {
+			delete(waiting, repoName)
+			changed = true
+			recordCI(rep, p, StatusTimeout, "等待 CI 超过 "+rep.CITimeout.String())
+			log.Printf("项目 %s 的提交 %s 等待 CI 超过 %s，不部署\n", repoName, p.Commit, rep.CITimeout)
+		}
+	}
+
+	if changed {
+		saveWaiting()
+	}
+}
+
+// checkWaiting 查询所有等待中的部署的 CI 结果。收不到 webhook 的项目（poll_interval）只能靠它
+func checkWaiting() {
+	ciLock.Lock()
+	loadWaiting()
+	list := make([]PendingDeploy, 0, len(waiting))
+	for _, p := range waiting {
+		list = append(list, p)
+	}
+	ciLock.Unlock()
+
+	for _, p := range list {
+		if rep, ok := GetRepo(p.Repo); ok && rep.RequireCI {
+			checkCI(p.Repo, rep, p)
+		}
+	}
+}
+
+// StartCIWatch 定时查询等待 CI 的部署（包括上次运行留下的）的结果，并检查是否超时
+func StartCIWatch() {
+	go func() {
+		for {
+			expireWaiting()
+			checkWaiting()
+			time.Sleep(30 * time.Second)
+		}
+	}()
+}
@@ -0,0 +1,116 @@
+package github
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+)
+
+func TestCIResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		contexts []string
+		checks   map[string]string
+		want     string
+	}{
+		{"没有检查", nil, map[string]string{}, ciPending},
+		{"全部通过", nil, map[string]string{"build": ciSuccess, "test": ciSuccess}, ciSuccess},
+		{"一项未完成", nil, map[string]string{"build": ciSuccess, "test": ciPending}, ciPending},
+		{"一项失败", nil, map[string]string{"build": ciPending, "lint": ciFailure}, ciFailure},
+		{"指定的检查通过", []string{"build", " test"}, map[string]string{"build": ciSuccess, "test": ciSuccess, "lint": ciFailure}, ciSuccess},
+		{"指定的检查还没有结果", []string{"build", "test"}, map[string]string{"build": ciSuccess}, ciPending},
+		{"指定的检查失败", []string{"build", "test"}, map[string]string{"build": ciSuccess, "test": ciFailure}, ciFailure},
+	}
+
+	for _, test := range tests {
+		got, reason := ciResult(Repo{CIContexts: test.contexts}, test.checks)
+		if got != test.want {
+			t.Errorf("%s: ciResult() = %s (%s)，应为 %s", test.name, got, reason, test.want)
+		}
+	}
+}
+
+func TestCheckWaiting(t *testing.T) {
+	var lock sync.Mutex
+	state := "in_progress"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/status"):
+			fmt.Fprint(w, `{"state":"pending","statuses":[]}`)
+		case strings.HasSuffix(r.URL.Path, "/check-runs"):
+			if state == "completed" {
+				fmt.Fprint(w, `{"total_count":1,"check_runs":[{"name":"test","status":"completed","conclusion":"success"}]}`)
+			} else {
+				fmt.Fprint(w, `{"total_count":1,"check_runs":[{"name":"test","status":"in_progress"}]}`)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "code-get-ci-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "deployed")
+	config := filepath.Join(dir, "repositories.conf")
+	data := fmt.Sprintf("api_url = %s/\nhtml_dir = %s\nstate_dir = %s\n\n[site]\nowner = acme\nrequire_ci = true\nrun = echo -n \"$COMMIT\" > %s\n",
+		server.URL, filepath.Join(dir, "html"), filepath.Join(dir, "state"), out)
+	if err := ioutil.WriteFile(config, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("GITHUB_AUTH_TOKEN", "tok")
+	defer os.Unsetenv("GITHUB_AUTH_TOKEN")
+	ParseConfig(config)
+
+	// 轮询发现的提交不会收到 CI 的 webhook
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	ciLock.Lock()
+	waiting = nil
+	loadWaiting()
+	waiting["site"] = PendingDeploy{Repo: "site", Commit: sha, Since: time.Now()}
+	saveWaiting()
+	ciLock.Unlock()
+
+	checkWaiting()
+	if list, _ := PendingDeploys(); len(list) != 1 {
+		t.Fatalf("CI 未完成时应继续等待: %+v", list)
+	}
+
+	lock.Lock()
+	state = "completed"
+	lock.Unlock()
+
+	checkWaiting()
+	if list, _ := PendingDeploys(); len(list) != 0 {
+		t.Errorf("CI 通过后不应继续等待: %+v", list)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		data, _ := ioutil.ReadFile(out)
+		if string(data) == sha {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("CI 通过后没有部署 %s: %q", sha, data)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,52 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	gh "github.com/google/go-github/github"
+	. "github.com/xiaosumay/server-code-mgr/utils"
+	"golang.org/x/oauth2"
+)
+
+// APIToken 返回访问 GitHub API 的令牌，依次使用参数、GITHUB_AUTH_TOKEN 和配置中的 github_token_file
+func APIToken(token string) (string, error) {
+	token = DefaultValue(token, os.Getenv("GITHUB_AUTH_TOKEN"))
+	if len(token) != 0 {
+		return token, nil
+	}
+
+	file := GetSettings().GithubTokenFile
+	if len(file) == 0 {
+		return "", fmt.Errorf("Unauthorized: No Token present")
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("读取 GitHub 令牌失败: %v", err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// NewClient 创建 GitHub API 客户端，配置了 api_url 时访问该地址（GitHub Enterprise 或测试用的替身）
+func NewClient(token string) (*gh.Client, context.Context, error) {
+	ctx := context.Background()
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+	tc := oauth2.NewClient(ctx, ts)
+
+	apiURL := GetSettings().APIURL
+	if len(apiURL) == 0 {
+		return gh.NewClient(tc), ctx, nil
+	}
+
+	client, err := gh.NewEnterpriseClient(apiURL, apiURL, tc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, ctx, nil
+}
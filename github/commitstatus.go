@@ -0,0 +1,188 @@
+package github
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	gh "github.com/google/go-github/github"
+	. "github.com/xiaosumay/server-code-mgr/utils"
+)
+
+// StatusContext 是部署结果在提交状态中的名称
+const StatusContext = "code-get/deploy"
+
+// forgeToken 依次从环境变量和令牌文件中读取访问 GitLab、Gitea API 的令牌
+func forgeToken(env, file string) (string, error) {
+	if token := os.Getenv(env); len(token) != 0 {
+		return token, nil
+	}
+
+	if len(file) == 0 {
+		return "", fmt.Errorf("没有配置 %s 或令牌文件", env)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("读取令牌失败: %v", err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// shortDescription 截断状态的描述，GitHub 限制最长 140 个字符
+func shortDescription(description string) string {
+	if r := []rune(description); len(r) > 140 {
+		return string(r[:140])
+	}
+	return description
+}
+
+// postJSON 以 JSON 格式提交 body，返回码不是 2xx 时返回错误
+func postJSON(url string, header http.Header, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s 返回 %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+func githubStatus(project, sha, state, description, target string) error {
+	parts := strings.SplitN(project, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("status_project %q 应为 owner/name", project)
+	}
+
+	token, err := APIToken("")
+	if err != nil {
+		return err
+	}
+
+	client, ctx, err := NewClient(token)
+	if err != nil {
+		return err
+	}
+
+	status := &gh.RepoStatus{
+		State:       gh.String(state),
+		Description: gh.String(description),
+		Context:     gh.String(StatusContext),
+	}
+	if len(target) != 0 {
+		status.TargetURL = gh.String(target)
+	}
+
+	_, _, err = client.Repositories.CreateStatus(ctx, parts[0], parts[1], sha, status)
+	return err
+}
+
+func gitlabStatus(project, sha, state, description, target string) error {
+	token, err := forgeToken("GITLAB_AUTH_TOKEN", GetSettings().GitlabTokenFile)
+	if err != nil {
+		return err
+	}
+
+	// GitLab 的失败状态是 failed
+	if state == "failure" {
+		state = "failed"
+	}
+
+	header := make(http.Header)
+	header.Set("PRIVATE-TOKEN", token)
+
+	return postJSON(
+		fmt.Sprintf("%s/api/v4/projects/%s/statuses/%s", strings.TrimRight(GetSettings().GitlabURL, "/"), url.PathEscape(project), sha),
+		header,
+		map[string]string{
+			"state":       state,
+			"name":        StatusContext,
+			"description": description,
+			"target_url":  target,
+		},
+	)
+}
+
+func giteaStatus(project, sha, state, description, target string) error {
+	token, err := forgeToken("GITEA_AUTH_TOKEN", GetSettings().GiteaTokenFile)
+	if err != nil {
+		return err
+	}
+
+	header := make(http.Header)
+	header.Set("Authorization", "token "+token)
+
+	return postJSON(
+		fmt.Sprintf("%s/api/v1/repos/%s/statuses/%s", strings.TrimRight(GetSettings().GiteaURL, "/"), project, sha),
+		header,
+		map[string]string{
+			"state":       state,
+			"context":     StatusContext,
+			"description": description,
+			"target_url":  target,
+		},
+	)
+}
+
+// reportCommitStatus 按项目的 commit_status 配置把部署结果作为提交状态报告给代码托管平台，
+// 没有变化的部署不报告，失败只记录日志
+func reportCommitStatus(repoName string, rep Repo, sha string, d Deployment) {
+	if len(rep.CommitStatus) == 0 || len(sha) == 0 {
+		return
+	}
+
+	var state, description string
+	switch d.Status {
+	case StatusSuccess:
+		state, description = "success", "已部署到 "+rep.Path
+	case StatusFailed:
+		state, description = "failure", d.Error
+	default:
+		return
+	}
+
+	description = shortDescription(description)
+	target := LogURL(repoName, d.ID)
+
+	var err error
+	switch rep.CommitStatus {
+	case "github":
+		err = githubStatus(rep.StatusProject, sha, state, description, target)
+	case "gitlab":
+		err = gitlabStatus(rep.StatusProject, sha, state, description, target)
+	case "gitea":
+		err = giteaStatus(rep.StatusProject, sha, state, description, target)
+	default:
+		err = fmt.Errorf("不支持的 commit_status %q", rep.CommitStatus)
+	}
+
+	if err != nil {
+		log.Printf("项目 %s 报告提交 %s 的部署状态失败: %v\n", repoName, sha, err)
+	}
+}
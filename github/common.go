@@ -2,228 +2,300 @@ package github
 
 import (
 	"fmt"
-	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	. "github.com/xiaosumay/server-code-mgr/utils"
-	"golang.org/x/crypto/ssh"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
-	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
 )
 
-func getAuth(key string) (*gitssh.PublicKeys, error) {
+// CloneRepos 克隆项目并切换到项目分支，项目已存在时什么也不做
+func CloneRepos(repoName string, rep Repo) error {
+	l := logger(repoName)
 
-	if _, err := os.Stat(key); err != nil {
-		key = fmt.Sprintf("/var/www/.ssh/%s", key)
+	localPath := filepath.Join(GetSettings().HtmlDir, repoName)
+	if len(rep.Path) != 0 {
+		localPath = rep.Path
 	}
 
-	priKey, err := ioutil.ReadFile(key)
-	if err != nil {
-		return nil, err
-	}
-
-	signer, err := ssh.ParsePrivateKey(priKey)
-	if err != nil {
-		return nil, err
-	}
-
-	auth := &gitssh.PublicKeys{
-		User:   gitssh.DefaultUsername,
-		Signer: signer,
-	}
-	auth.HostKeyCallback = ssh.InsecureIgnoreHostKey()
-
-	return auth, nil
-}
-
-func CloneRepos(repoName string, rep Repo) {
-	localPath := DefaultValue(rep.Path, "/var/www/html/"+repoName)
-
-	log.Println(localPath)
+	l.Println(localPath)
 
 	if _, err := os.Stat(localPath + "/.git"); err == nil {
-		log.Printf("项目 %s 已存在\n", repoName)
-		return
+		l.Printf("项目 %s 已存在\n", repoName)
+		return nil
 	}
 
 	err := os.RemoveAll(localPath)
 	if err != nil {
-		log.Println(err)
+		l.Println(err)
 	}
 
-	auth, err := getAuth(rep.Key)
+	auth, err := getAuth(rep)
 	if err != nil {
-		log.Println(err)
-		return
+		l.Println(err)
+		return err
 	}
 
-	r, err := git.PlainClone(localPath, false, &git.CloneOptions{
-		Auth:     auth,
-		URL:      rep.RemotePath,
-		Progress: os.Stdout,
-		Tags:     git.AllTags,
+	// 直接检出配置的分支，不依赖远程仓库的默认分支
+	_, err = git.PlainClone(localPath, false, &git.CloneOptions{
+		Auth:          auth,
+		URL:           rep.RemotePath,
+		ReferenceName: plumbing.NewBranchReferenceName(rep.Branch),
+		Progress:      output(repoName),
+		Tags:          git.AllTags,
 	})
 
 	if err != nil {
-		log.Println(err)
-		return
+		l.Println(err)
+		return err
 	}
 
-	w, err := r.Worktree()
-	if err != nil {
-		log.Println(err)
-		return
-	}
+	l.Println("下载成功！")
+	return nil
+}
 
-	if rep.Branch != "master" {
-		remoteRef, err := r.Reference(
-			plumbing.NewRemoteReferenceName("origin", rep.Branch),
-			true,
-		)
-		if err != nil {
-			log.Println(err)
-			return
-		}
+func runCommand(repoName string, rep Repo, commit string) error {
+	l := logger(repoName)
 
-		err = w.Checkout(&git.CheckoutOptions{
-			Hash:   remoteRef.Hash(),
-			Branch: plumbing.NewBranchReferenceName(rep.Branch),
-			Create: true,
-			Keep:   true,
-			Force:  true,
-		})
+	var cmd *exec.Cmd
 
+	if len(rep.Run) != 0 {
+		cmd = exec.Command("bash", "-e", "-c", rep.Run)
+		if _, err := os.Stat(rep.Path); err == nil {
+			cmd.Dir = rep.Path
+		}
+	} else {
+		script, err := ScriptPath(rep.Script)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
+		cmd = exec.Command("bash", script)
 	}
 
-	log.Println("下载成功！")
-}
-
-func runCommand(repoName string, rep Repo) bool {
-	if _, err := os.Stat(rep.Script); err != nil {
-		rep.Script = fmt.Sprintf("/var/www/.scripts/%s", rep.Script)
-		if _, err := os.Stat(rep.Script); err != nil {
-			return false
-		}
+	env := []string{"BRANCH=" + Quote(rep.Branch), "WORK_PATH=" + Quote(rep.Path), "REPOS=" + Quote(repoName)}
+	if len(commit) != 0 {
+		env = append(env, "COMMIT="+Quote(commit))
 	}
 
-	cmd := exec.Command("bash", rep.Script)
-	cmd.Env = append(cmd.Env, "BRANCH="+Quote(rep.Branch), "WORK_PATH="+Quote(rep.Path), "REPOS="+Quote(repoName))
-	if 0 != len(rep.Key) {
-		key := rep.Key
-		if _, err := os.Stat(key); err != nil {
-			key = fmt.Sprintf("/var/www/.ssh/%s", key)
-		}
-
-		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND=ssh -v -i "+Quote(key))
+	gitEnv, cleanup, err := gitCredentialEnv(rep)
+	if err != nil {
+		return err
 	}
+	defer cleanup()
 
-	log.Println(strings.Join(cmd.Env, " "))
+	env = append(env, gitEnv...)
+
+	// 与 runHook 相同，保留服务自身的环境变量（HOME、PATH 等），只打印新增的部分
+	l.Println(strings.Join(env, " "))
+	cmd.Env = append(os.Environ(), env...)
 
 	data, err := cmd.CombinedOutput()
 
-	log.Println(string(data))
+	l.Println(string(data))
 
-	if err != nil {
-		log.Println(err)
-		return false
-	}
+	return err
+}
 
-	return true
+// Request 是一次部署请求
+type Request struct {
+	// Commit 是要部署的提交，为空时部署分支的最新提交
+	Commit string
+	// Force 表示来自强制推送，Commit 早于已部署的版本时同样部署
+	Force bool
+	// Tag 是配置了 release_asset 的项目要部署的 release，为空时部署最新的 release
+	Tag string
 }
 
-func DoReposUpdate(repoName string, rep Repo) {
-	for {
-		if len(rep.Script) == 0 {
-			break
-		}
+// refusedError 表示按配置拒绝部署，而不是部署失败
+type refusedError string
 
-		log.Printf("启用自定义脚本: %s\n", rep.Script)
+func (e refusedError) Error() string {
+	return string(e)
+}
+
+// DoReposUpdate 拉取项目分支并部署请求的提交。提交已经部署过（是当前版本或它的祖先）时跳过，
+// 强制推送和刚克隆的项目除外；allow_force = false 时拒绝不在已部署版本之后的提交（被改写的历史），
+// 返回部署失败的原因
+func DoReposUpdate(repoName string, rep Repo, req Request) error {
+	l := logger(repoName)
 
-		if runCommand(repoName, rep) {
-			return
+	if len(rep.ReleaseAsset) != 0 {
+		return deployRelease(repoName, rep, req)
+	}
+
+	if len(rep.Run) != 0 || len(rep.Script) != 0 {
+		if len(rep.Run) != 0 {
+			l.Println("启用内联命令")
+		} else {
+			l.Printf("启用自定义脚本: %s\n", rep.Script)
 		}
 
-		break
+		return runCommand(repoName, rep, req.Commit)
 	}
 
+	// 刚克隆的项目还没有执行过部署步骤
+	cloned := false
 	if _, err := os.Stat(rep.Path + "/.git"); err != nil {
-		CloneRepos(repoName, rep)
+		if err := CloneRepos(repoName, rep); err != nil {
+			return err
+		}
+		cloned = true
 	}
 
 	r, err := git.PlainOpenWithOptions(rep.Path, &git.PlainOpenOptions{
 		DetectDotGit: false,
 	})
-
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
-	auth, err := getAuth(rep.Key)
+	auth, err := getAuth(rep)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
 	err = r.Fetch(&git.FetchOptions{
 		Auth:     auth,
 		Force:    true,
-		Progress: os.Stdout,
+		Progress: output(repoName),
 		Tags:     git.AllTags,
 	})
-
-	if err != nil {
-		log.Println(err)
-		return
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
 	}
 
-	log.Println("强制拉去完成")
+	l.Println("强制拉去完成")
 
 	remoteRef, err := r.Reference(
 		plumbing.NewRemoteReferenceName("origin", rep.Branch),
 		true,
 	)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
 	localRef, err := r.Reference(plumbing.NewBranchReferenceName(rep.Branch), true)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
+	}
+
+	l.Println(remoteRef)
+	l.Println(localRef)
+
+	target := remoteRef.Hash()
+	if len(req.Commit) != 0 {
+		target = plumbing.NewHash(req.Commit)
+	}
+
+	if target == localRef.Hash() && !cloned {
+		l.Println("已经是最新的了！")
+		return nil
+	}
+
+	// 刚克隆的项目虽然检出了分支的最新提交，但还没有部署过，不能当作已部署跳过
+	if len(req.Commit) != 0 && (req.Force || cloned) {
+		if _, err := r.CommitObject(target); err != nil {
+			return fmt.Errorf("提交 %s 不在远程分支中: %v", target, err)
+		}
+	} else if len(req.Commit) != 0 {
+		deployed, err := deployedAncestor(r, target, localRef.Hash())
+		if err != nil {
+			return err
+		}
+		if deployed {
+			l.Printf("提交 %s 早于已部署的 %s，跳过\n", target, localRef.Hash())
+			return nil
+		}
+	}
+
+	// 强制推送之后的普通推送和轮询同样基于被改写的历史
+	if !req.Force && !rep.AllowForce && !cloned {
+		deployed, err := r.CommitObject(localRef.Hash())
+		if err != nil {
+			return err
+		}
+		commit, err := r.CommitObject(target)
+		if err != nil {
+			return fmt.Errorf("提交 %s 不在远程分支中: %v", target, err)
+		}
+
+		descendant, err := deployed.IsAncestor(commit)
+		if err != nil {
+			return err
+		}
+		if !descendant {
+			return refusedError(fmt.Sprintf("提交 %s 不在已部署的 %s 之后（分支历史被改写），allow_force = false，不部署", target, localRef.Hash()))
+		}
+	}
+
+	return checkout(repoName, rep, r, target)
+}
+
+// deployedAncestor 判断 target 是否是已部署的 current 的祖先，
+// target 不在仓库中（例如已被强制推送覆盖）时返回错误
+func deployedAncestor(r *git.Repository, target, current plumbing.Hash) (bool, error) {
+	commit, err := r.CommitObject(target)
+	if err != nil {
+		return false, fmt.Errorf("提交 %s 不在远程分支中: %v", target, err)
+	}
+
+	deployed, err := r.CommitObject(current)
+	if err != nil {
+		return false, nil
+	}
+
+	return commit.IsAncestor(deployed)
+}
+
+// runHook 在部署目录中执行配置的 shell 命令，环境变量与部署脚本相同
+func runHook(repoName string, rep Repo, name, command string) error {
+	l := logger(repoName)
+	l.Printf("执行 %s: %s\n", name, command)
+
+	cmd := exec.Command("bash", "-e", "-c", command)
+	if _, err := os.Stat(rep.Path); err == nil {
+		cmd.Dir = rep.Path
 	}
+	cmd.Env = append(os.Environ(), "BRANCH="+rep.Branch, "WORK_PATH="+rep.Path, "REPOS="+repoName)
+
+	data, err := cmd.CombinedOutput()
+	l.Println(string(data))
 
-	log.Println(remoteRef)
-	log.Println(localRef)
+	if err != nil {
+		return fmt.Errorf("%s 执行失败: %v", name, err)
+	}
+	return nil
+}
 
-	if remoteRef.Hash() == localRef.Hash() {
-		log.Println("已经是最新的了！")
-		return
+// checkout 把工作区切换到 hash 并执行清单中的部署步骤
+func checkout(repoName string, rep Repo, r *git.Repository, hash plumbing.Hash) error {
+	m, err := loadManifest(repoName, rep, r, hash)
+	if err != nil {
+		return err
 	}
 
 	w, err := r.Worktree()
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
 	err = w.Reset(&git.ResetOptions{
-		Commit: remoteRef.Hash(),
+		Commit: hash,
 		Mode:   git.HardReset,
 	})
 	if err != nil {
-		log.Println(err)
-		return
+		return err
+	}
+
+	if m != nil {
+		if err := m.apply(repoName, rep, hash); err != nil {
+			return err
+		}
 	}
 
-	log.Println("更新完成")
+	logger(repoName).Println("更新完成")
+	return nil
 }
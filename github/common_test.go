@@ -0,0 +1,105 @@
+package github
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// commitFile 在 w 中写入文件并提交，返回新的提交
+func commitFile(t *testing.T, w *git.Worktree, dir, content string) plumbing.Hash {
+	t.Helper()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add("index.html"); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := w.Commit(content, &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestDoReposUpdateRewrittenHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "code-get-update-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	r, err := git.PlainInit(src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := commitFile(t, w, src, "a")
+	deployed := commitFile(t, w, src, "b")
+
+	if _, err := GenerateKey(filepath.Join(dir, "keys", "site"), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "known_hosts"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := filepath.Join(dir, "repositories.conf")
+	data := fmt.Sprintf("html_dir = %s\nstate_dir = %s\nkey_dir = %s\nknown_hosts = %s\n\n[site]\nremote_path = file://%s\nallow_force = false\n",
+		filepath.Join(dir, "html"), filepath.Join(dir, "state"), filepath.Join(dir, "keys"), filepath.Join(dir, "known_hosts"), src)
+	if err := ioutil.WriteFile(config, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ParseConfig(config)
+	rep, _ := GetRepo("site")
+
+	if d := Deploy("site", rep, Request{Commit: deployed.String()}); d.Status != StatusSuccess {
+		t.Fatalf("第一次部署 = %s (%s)", d.Status, d.Error)
+	}
+
+	// 改写历史：回到第一个提交后重新提交
+	if err := w.Reset(&git.ResetOptions{Commit: first, Mode: git.HardReset}); err != nil {
+		t.Fatal(err)
+	}
+	rewritten := commitFile(t, w, src, "c")
+
+	if d := Deploy("site", rep, Request{Commit: rewritten.String()}); d.Status != StatusRefused {
+		t.Errorf("被改写的历史上的推送 = %s (%s)，应为 %s", d.Status, d.Error, StatusRefused)
+	}
+	if d := Deploy("site", rep, Request{}); d.Status != StatusRefused {
+		t.Errorf("部署被改写的分支 = %s (%s)，应为 %s", d.Status, d.Error, StatusRefused)
+	}
+	if head := LocalHead(rep.Path); head != deployed.String() {
+		t.Errorf("拒绝部署后部署目录是 %s，应为 %s", head, deployed)
+	}
+
+	if d := Deploy("site", rep, Request{Force: true}); d.Status != StatusSuccess {
+		t.Errorf("强制部署 = %s (%s)", d.Status, d.Error)
+	}
+
+	// 之后的提交在已部署的版本之后，照常部署
+	next := commitFile(t, w, src, "d")
+	if d := Deploy("site", rep, Request{Commit: next.String()}); d.Status != StatusSuccess {
+		t.Errorf("普通推送 = %s (%s)", d.Status, d.Error)
+	}
+	if head := LocalHead(rep.Path); head != next.String() {
+		t.Errorf("部署目录是 %s，应为 %s", head, next)
+	}
+}
@@ -0,0 +1,105 @@
+package github
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	gh "github.com/google/go-github/github"
+	. "github.com/xiaosumay/server-code-mgr/utils"
+)
+
+type deploymentPayload struct {
+	Deployment struct {
+		ID          int64  `json:"id"`
+		SHA         string `json:"sha"`
+		Ref         string `json:"ref"`
+		Environment string `json:"environment"`
+	} `json:"deployment"`
+	Repository struct {
+		Name  string `json:"name"`
+		Owner struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	} `json:"repository"`
+}
+
+// LogURL 按配置的 log_url 模板生成部署日志的地址，没有配置时返回空
+func LogURL(repoName, id string) string {
+	url := GetSettings().LogURL
+	if len(url) == 0 {
+		return ""
+	}
+
+	return strings.NewReplacer("{name}", repoName, "{id}", id).Replace(url)
+}
+
+// deploymentStatus 向 GitHub 报告部署状态，失败只记录日志
+func deploymentStatus(owner, repoName string, id int64, state, description, logURL string) {
+	token, err := APIToken("")
+	if err != nil {
+		log.Printf("项目 %s 无法报告部署状态: %v\n", repoName, err)
+		return
+	}
+
+	client, ctx, err := NewClient(token)
+	if err != nil {
+		log.Printf("项目 %s 无法报告部署状态: %v\n", repoName, err)
+		return
+	}
+
+	description = shortDescription(description)
+
+	req := &gh.DeploymentStatusRequest{
+		State:       &state,
+		Description: &description,
+	}
+	if len(logURL) != 0 {
+		req.LogURL = &logURL
+	}
+
+	if _, _, err := client.Repositories.CreateDeploymentStatus(ctx, owner, repoName, id, req); err != nil {
+		log.Printf("项目 %s 报告部署状态 %s 失败: %v\n", repoName, state, err)
+	}
+}
+
+// DeploymentEvent 处理 GitHub Deployments API 创建的部署：environment 与项目配置一致时
+// 部署其中的提交，并通过部署状态报告进度和结果
+func DeploymentEvent(data []byte) bool {
+	var payload deploymentPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		log.Println(err)
+		return false
+	}
+
+	repoName := payload.Repository.Name
+	rep, ok := GetRepo(repoName)
+	if !ok {
+		log.Println(repoName + " 不存在！")
+		return false
+	}
+
+	deployment := payload.Deployment
+	if deployment.Environment != rep.Environment {
+		log.Printf("项目 %s 的部署 %d 是 %s 环境的，这里是 %s，忽略\n", repoName, deployment.ID, deployment.Environment, rep.Environment)
+		return true
+	}
+
+	owner := payload.Repository.Owner.Login
+
+	go func() {
+		log.Printf("项目 %s 开始部署 %s (%s)\n", repoName, deployment.Ref, deployment.SHA)
+		deploymentStatus(owner, repoName, deployment.ID, "in_progress", "正在部署 "+deployment.Ref, "")
+
+		// 部署请求可能指向更早的提交（例如回滚），按强制推送处理
+		d := Deploy(repoName, rep, Request{Commit: deployment.SHA, Force: true})
+
+		if d.Status == StatusFailed {
+			deploymentStatus(owner, repoName, deployment.ID, "failure", d.Error, LogURL(repoName, d.ID))
+		} else {
+			deploymentStatus(owner, repoName, deployment.ID, "success", "已部署 "+deployment.SHA, LogURL(repoName, d.ID))
+		}
+	}()
+
+	return true
+}
@@ -0,0 +1,186 @@
+package github
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+)
+
+type deploymentStatusRequest struct {
+	Path        string
+	State       string `json:"state"`
+	Description string `json:"description"`
+	LogURL      string `json:"log_url"`
+}
+
+// fakeDeployments 是 GitHub API 的替身，记录收到的部署状态
+type fakeDeployments struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []deploymentStatusRequest
+}
+
+func newFakeDeployments(t *testing.T) *fakeDeployments {
+	f := &fakeDeployments{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/statuses") {
+			t.Errorf("不应请求 %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		status := deploymentStatusRequest{Path: r.URL.Path}
+		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+			t.Error(err)
+		}
+
+		f.mu.Lock()
+		f.statuses = append(f.statuses, status)
+		f.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":1}`)
+	}))
+
+	return f
+}
+
+// wait 等待收到 n 个部署状态，部署在后台执行
+func (f *fakeDeployments) wait(t *testing.T, n int) []deploymentStatusRequest {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		f.mu.Lock()
+		statuses := append([]deploymentStatusRequest(nil), f.statuses...)
+		f.mu.Unlock()
+
+		if len(statuses) >= n || time.Now().After(deadline) {
+			return statuses
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// setupDeployments 加载 api_url 指向 f 的配置：ok 项目部署成功，broken 项目部署失败
+func setupDeployments(t *testing.T, f *fakeDeployments) func() {
+	dir, err := ioutil.TempDir("", "code-get-deployment-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := filepath.Join(dir, "repositories.conf")
+	data := fmt.Sprintf(`api_url = %s/
+log_url = https://deploy.example.com/logs/{name}/{id}.log
+html_dir = %s
+state_dir = %s
+
+[ok]
+owner = acme
+run = true
+
+[broken]
+owner = acme
+run = exit 3
+`, f.URL, filepath.Join(dir, "html"), filepath.Join(dir, "state"))
+	if err := ioutil.WriteFile(config, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("GITHUB_AUTH_TOKEN", "tok")
+	ParseConfig(config)
+
+	return func() {
+		os.Unsetenv("GITHUB_AUTH_TOKEN")
+		os.RemoveAll(dir)
+	}
+}
+
+func deploymentEvent(repoName string, id int64, environment string) []byte {
+	return []byte(fmt.Sprintf(`{
+	"deployment": {"id": %d, "sha": "0123456789abcdef0123456789abcdef01234567", "ref": "master", "environment": %q},
+	"repository": {"name": %q, "owner": {"login": "acme"}}
+}`, id, environment, repoName))
+}
+
+func TestDeploymentEvent(t *testing.T) {
+	f := newFakeDeployments(t)
+	defer f.Close()
+	defer setupDeployments(t, f)()
+
+	tests := []struct {
+		repo  string
+		id    int64
+		state string
+	}{
+		{"ok", 11, "success"},
+		{"broken", 12, "failure"},
+	}
+
+	for _, test := range tests {
+		f.mu.Lock()
+		f.statuses = nil
+		f.mu.Unlock()
+
+		if !DeploymentEvent(deploymentEvent(test.repo, test.id, "production")) {
+			t.Fatalf("%s: DeploymentEvent 返回 false", test.repo)
+		}
+
+		statuses := f.wait(t, 2)
+		if len(statuses) != 2 {
+			t.Fatalf("%s: 收到的部署状态 = %+v，应为 in_progress 和 %s", test.repo, statuses, test.state)
+		}
+
+		path := fmt.Sprintf("/repos/acme/%s/deployments/%d/statuses", test.repo, test.id)
+		for _, status := range statuses {
+			if status.Path != path {
+				t.Errorf("%s: 部署状态发送到 %s，应为 %s", test.repo, status.Path, path)
+			}
+		}
+
+		if statuses[0].State != "in_progress" {
+			t.Errorf("%s: 第一个部署状态 = %s，应为 in_progress", test.repo, statuses[0].State)
+		}
+
+		final := statuses[1]
+		if final.State != test.state {
+			t.Errorf("%s: 部署结果 = %s (%s)，应为 %s", test.repo, final.State, final.Description, test.state)
+		}
+
+		list, err := History(test.repo)
+		if err != nil || len(list) == 0 {
+			t.Fatalf("%s: 没有部署记录: %v", test.repo, err)
+		}
+		want := fmt.Sprintf("https://deploy.example.com/logs/%s/%s.log", test.repo, list[0].ID)
+		if final.LogURL != want {
+			t.Errorf("%s: log_url = %q，应为 %q", test.repo, final.LogURL, want)
+		}
+	}
+}
+
+func TestDeploymentEventOtherEnvironment(t *testing.T) {
+	f := newFakeDeployments(t)
+	defer f.Close()
+	defer setupDeployments(t, f)()
+
+	if !DeploymentEvent(deploymentEvent("ok", 13, "staging")) {
+		t.Fatal("DeploymentEvent 返回 false")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if statuses := f.wait(t, 0); len(statuses) != 0 {
+		t.Errorf("其他环境的部署不应报告状态: %+v", statuses)
+	}
+}
@@ -0,0 +1,319 @@
+package github
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+const (
+	StatusSuccess   = "success"
+	StatusFailed    = "failed"
+	StatusUnchanged = "unchanged"
+	StatusAccepted  = "accepted"
+	StatusRefused   = "refused"
+
+	ActionDeploy    = "deploy"
+	ActionRollback  = "rollback"
+	ActionForcePush = "force-push"
+)
+
+// Deployment 是一次部署的记录，按项目保存在 state_dir/history/<项目名>.json 中，每行一条
+type Deployment struct {
+	ID       string    `json:"id"`
+	Repo     string    `json:"repo"`
+	Branch   string    `json:"branch"`
+	Action   string    `json:"action"`
+	Before   string    `json:"before,omitempty"`
+	After    string    `json:"after,omitempty"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"`
+	Log      string    `json:"log,omitempty"`
+}
+
+var (
+	deployMutex sync.Mutex
+	deployLocks = make(map[string]*sync.Mutex)
+	deployLogs  = make(map[string]io.Writer)
+)
+
+// repoLock 返回项目的部署锁，同一个项目同时只能有一个部署
+func repoLock(repoName string) *sync.Mutex {
+	deployMutex.Lock()
+	defer deployMutex.Unlock()
+
+	lock, ok := deployLocks[repoName]
+	if !ok {
+		lock = new(sync.Mutex)
+		deployLocks[repoName] = lock
+	}
+	return lock
+}
+
+// output 返回项目部署过程的输出，部署期间同时写入本次部署的日志文件
+func output(repoName string) io.Writer {
+	deployMutex.Lock()
+	defer deployMutex.Unlock()
+
+	if w, ok := deployLogs[repoName]; ok {
+		return w
+	}
+	return os.Stderr
+}
+
+// logger 返回项目部署过程的日志，以项目名开头，便于区分同时部署的多个项目
+func logger(repoName string) *log.Logger {
+	return log.New(output(repoName), "["+repoName+"] ", log.LstdFlags)
+}
+
+// LocalHead 返回部署目录当前的提交，release 部署的项目返回 release 标签，都不是时返回空
+func LocalHead(path string) string {
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		// release 部署的项目目录是指向 release 目录的符号链接
+		if target, err := os.Readlink(path); err == nil {
+			return filepath.Base(target)
+		}
+		return ""
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		return ""
+	}
+
+	return head.Hash().String()
+}
+
+func historyFile(repoName string) string {
+	return filepath.Join(GetSettings().StateDir, "history", repoName+".json")
+}
+
+func appendHistory(d Deployment) error {
+	file := historyFile(d.Repo)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(d)
+}
+
+// History 返回项目的部署记录，最新的在前；不指定项目时返回所有项目的记录
+func History(repoNames ...string) ([]Deployment, error) {
+	if len(repoNames) == 0 {
+		files, err := filepath.Glob(filepath.Join(GetSettings().StateDir, "history", "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			repoNames = append(repoNames, strings.TrimSuffix(filepath.Base(file), ".json"))
+		}
+	}
+
+	var list []Deployment
+	for _, name := range repoNames {
+		f, err := os.Open(historyFile(name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var d Deployment
+			if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("部署记录 %s 格式错误: %v", historyFile(name), err)
+			}
+			list = append(list, d)
+		}
+		f.Close()
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Start.After(list[j].Start)
+	})
+
+	return list, nil
+}
+
+// record 执行一次部署并记录到部署历史，部署过程的输出保存在
+// state_dir/logs/<项目名>/<部署ID>.log
+func record(repoName string, rep Repo, action string, fn func() error) Deployment {
+	lock := repoLock(repoName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	start := time.Now()
+	d := Deployment{
+		ID:     start.Format("20060102-150405.000"),
+		Repo:   repoName,
+		Branch: rep.Branch,
+		Action: action,
+		Before: LocalHead(rep.Path),
+		Start:  start,
+	}
+
+	logFile := filepath.Join(GetSettings().StateDir, "logs", repoName, d.ID+".log")
+	if err := os.MkdirAll(filepath.Dir(logFile), 0755); err != nil {
+		log.Println(err)
+	} else if f, err := os.Create(logFile); err != nil {
+		log.Println(err)
+	} else {
+		d.Log = logFile
+
+		deployMutex.Lock()
+		deployLogs[repoName] = io.MultiWriter(os.Stderr, f)
+		deployMutex.Unlock()
+
+		defer func() {
+			deployMutex.Lock()
+			delete(deployLogs, repoName)
+			deployMutex.Unlock()
+			f.Close()
+		}()
+	}
+
+	err := fn()
+
+	d.After = LocalHead(rep.Path)
+	d.Duration = time.Since(start).Seconds()
+
+	switch _, refused := err.(refusedError); {
+	case refused:
+		d.Status = StatusRefused
+		d.Error = err.Error()
+		logger(repoName).Printf("项目 %s 拒绝部署: %v\n", repoName, err)
+	case err != nil:
+		d.Status = StatusFailed
+		d.Error = err.Error()
+		logger(repoName).Printf("项目 %s 部署失败: %v\n", repoName, err)
+	case d.Before == d.After && len(rep.Run) == 0 && len(rep.Script) == 0:
+		d.Status = StatusUnchanged
+	default:
+		d.Status = StatusSuccess
+	}
+
+	if err := appendHistory(d); err != nil {
+		log.Println(err)
+	}
+
+	return d
+}
+
+// Deploy 部署项目并记录到部署历史
+func Deploy(repoName string, rep Repo, req Request) Deployment {
+	d := record(repoName, rep, ActionDeploy, func() error {
+		return DoReposUpdate(repoName, rep, req)
+	})
+
+	// 部署失败时本地仍是旧的提交，状态报告在请求部署的提交上
+	sha := req.Commit
+	if len(sha) == 0 && d.Status == StatusSuccess {
+		sha = d.After
+	}
+
+	// release 部署的版本是标签，提交状态报告在标签指向的提交上
+	if len(rep.ReleaseAsset) != 0 {
+		tag := req.Tag
+		if len(tag) == 0 && d.Status == StatusSuccess {
+			tag = d.After
+		}
+		sha = releaseCommit(repoName, rep, tag)
+	}
+
+	reportCommitStatus(repoName, rep, sha, d)
+
+	return d
+}
+
+// rollbackTarget 找到回滚的目标提交：target 可以是部署记录的 ID 或提交，
+// 为空时是当前版本之前最近一次部署成功的版本
+func rollbackTarget(r *git.Repository, repoName, current, target string) (plumbing.Hash, error) {
+	list, err := History(repoName)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	for _, d := range list {
+		if len(target) == 0 && d.Status == StatusSuccess && len(d.After) != 0 && d.After != current {
+			return plumbing.NewHash(d.After), nil
+		}
+		if len(target) != 0 && d.ID == target {
+			if len(d.After) == 0 {
+				return plumbing.ZeroHash, fmt.Errorf("部署记录 %s 没有对应的提交", target)
+			}
+			return plumbing.NewHash(d.After), nil
+		}
+	}
+
+	if len(target) == 0 {
+		return plumbing.ZeroHash, fmt.Errorf("项目 %s 没有可以回滚的部署记录", repoName)
+	}
+
+	hash, err := r.ResolveRevision(plumbing.Revision(target))
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("找不到部署记录或提交 %s", target)
+	}
+
+	return *hash, nil
+}
+
+// Rollback 把项目切换回之前部署的版本并重新执行部署步骤，
+// 找不到回滚目标时返回错误，不记录部署历史
+func Rollback(repoName string, rep Repo, target string) (Deployment, error) {
+	if len(rep.Run) != 0 || len(rep.Script) != 0 {
+		return Deployment{}, fmt.Errorf("项目 %s 使用自定义脚本部署，不支持回滚", repoName)
+	}
+	if len(rep.ReleaseAsset) != 0 {
+		return Deployment{}, fmt.Errorf("项目 %s 使用 release 部署，不支持回滚", repoName)
+	}
+
+	r, err := git.PlainOpen(rep.Path)
+	if err != nil {
+		return Deployment{}, err
+	}
+
+	hash, err := rollbackTarget(r, repoName, LocalHead(rep.Path), target)
+	if err != nil {
+		return Deployment{}, err
+	}
+
+	if _, err := r.CommitObject(hash); err != nil {
+		return Deployment{}, fmt.Errorf("提交 %s 不在本地仓库中: %v", hash, err)
+	}
+
+	d := record(repoName, rep, ActionRollback, func() error {
+		logger(repoName).Printf("回滚到 %s\n", hash)
+		return checkout(repoName, rep, r, hash)
+	})
+	reportCommitStatus(repoName, rep, hash.String(), d)
+
+	return d, nil
+}
@@ -0,0 +1,106 @@
+package github
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// GenerateKey 生成 ed25519 密钥对，私钥写入 path，公钥写入 path.pub
+func GenerateKey(path, comment string) (ssh.PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := marshalED25519(priv, comment)
+	if err != nil {
+		return nil, err
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+
+	authorized := ssh.MarshalAuthorizedKey(sshPub)
+	authorized = append(authorized[:len(authorized)-1], []byte(" "+comment+"\n")...)
+
+	if err := ioutil.WriteFile(path+".pub", authorized, 0644); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	return sshPub, nil
+}
+
+// AuthorizedKey 把公钥编码成 authorized_keys 中的一行，不带换行
+func AuthorizedKey(pub ssh.PublicKey) string {
+	authorized := ssh.MarshalAuthorizedKey(pub)
+	return string(authorized[:len(authorized)-1])
+}
+
+// ReadPublicKey 读取私钥对应的公钥
+func ReadPublicKey(rep Repo) (ssh.PublicKey, error) {
+	key, err := loadPrivateKey(rep)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return signer.PublicKey(), nil
+}
+
+// ListRemote 相当于 git ls-remote，用项目配置的凭据列出远程仓库的引用
+func ListRemote(rep Repo) ([]*plumbing.Reference, error) {
+	auth, err := getAuth(rep)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{rep.RemotePath},
+	})
+
+	return remote.List(&git.ListOptions{Auth: auth})
+}
+
+// RemoteHead 返回远程仓库中项目分支的最新提交
+func RemoteHead(rep Repo) (plumbing.Hash, error) {
+	refs, err := ListRemote(rep)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	name := plumbing.NewBranchReferenceName(rep.Branch)
+	for _, ref := range refs {
+		if ref.Name() == name {
+			return ref.Hash(), nil
+		}
+	}
+
+	return plumbing.ZeroHash, fmt.Errorf("远程仓库中没有分支 %s", rep.Branch)
+}
@@ -0,0 +1,144 @@
+package github
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+var errHostKeyScanned = errors.New("host key scanned")
+
+// KnownHostsFile 返回项目使用的 known_hosts，项目没有单独配置时使用全局配置
+func KnownHostsFile(rep Repo) string {
+	if len(rep.KnownHosts) != 0 {
+		return rep.KnownHosts
+	}
+	return GetSettings().KnownHosts
+}
+
+// hostKeyCallback 严格按 known_hosts 校验主机公钥，文件不存在或主机未登记时拒绝连接
+func hostKeyCallback(rep Repo) (ssh.HostKeyCallback, error) {
+	file := KnownHostsFile(rep)
+
+	if _, err := os.Stat(file); err != nil {
+		return nil, fmt.Errorf("known_hosts 文件 %s 不存在，请先执行 code-get known-hosts add <host>", file)
+	}
+
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("known_hosts 文件 %s 格式错误: %v", file, err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+
+		if keyErr, ok := err.(*knownhosts.KeyError); ok {
+			if len(keyErr.Want) == 0 {
+				return fmt.Errorf("主机 %s 不在 %s 中，请先执行 code-get known-hosts add %s", hostname, file, hostname)
+			}
+			return fmt.Errorf("主机 %s 的公钥 %s 与 %s 中登记的不一致，可能遭受中间人攻击", hostname, ssh.FingerprintSHA256(key), file)
+		}
+
+		return err
+	}, nil
+}
+
+// sshHostOptions 是交给 ssh 命令行的主机校验参数，和 go-git 的校验保持一致
+func sshHostOptions(rep Repo) string {
+	return "-o StrictHostKeyChecking=yes -o UserKnownHostsFile=" + Quote(KnownHostsFile(rep))
+}
+
+// RemoteHost 返回远程仓库地址中的 host:port，可用于 known-hosts add
+func RemoteHost(remote string) (string, error) {
+	endpoint, err := transport.NewEndpoint(remote)
+	if err != nil {
+		return "", err
+	}
+
+	port := endpoint.Port
+	if port == 0 {
+		port = 22
+	}
+
+	return net.JoinHostPort(endpoint.Host, strconv.Itoa(port)), nil
+}
+
+// HostAddr 为没有端口的主机名补上默认的 22 端口
+func HostAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, "22")
+	}
+	return addr
+}
+
+// ScanHostKey 连接主机并取得它的公钥，不做任何认证
+func ScanHostKey(addr string) (ssh.PublicKey, error) {
+	addr = HostAddr(addr)
+
+	var hostKey ssh.PublicKey
+
+	_, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: gitssh.DefaultUsername,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errHostKeyScanned
+		},
+		Timeout: 10 * time.Second,
+	})
+
+	if hostKey != nil {
+		return hostKey, nil
+	}
+
+	return nil, err
+}
+
+// KnownHost 检查主机公钥在 known_hosts 中的状态：已登记返回 true，
+// 登记的公钥不一致时返回错误
+func KnownHost(file, addr string, key ssh.PublicKey) (bool, error) {
+	if _, err := os.Stat(file); err != nil {
+		return false, nil
+	}
+
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return false, err
+	}
+
+	err = callback(HostAddr(addr), &net.TCPAddr{}, key)
+	if err == nil {
+		return true, nil
+	}
+
+	if keyErr, ok := err.(*knownhosts.KeyError); ok && len(keyErr.Want) == 0 {
+		return false, nil
+	}
+
+	return false, err
+}
+
+// AddKnownHost 把主机公钥追加到 known_hosts
+func AddKnownHost(file, addr string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(HostAddr(addr))}, key))
+	return err
+}
@@ -0,0 +1,230 @@
+package github
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/yaml.v2"
+)
+
+const manifestName = ".code-get.yml"
+
+var manifestSections = []string{"build", "shared", "env", "health_check"}
+
+type healthCheck struct {
+	URL     string `yaml:"url"`
+	Timeout int    `yaml:"timeout"`
+	Retries int    `yaml:"retries"`
+}
+
+// manifest 是仓库根目录下 .code-get.yml 描述的部署步骤
+type manifest struct {
+	Build       []string          `yaml:"build"`
+	Shared      []string          `yaml:"shared"`
+	Env         map[string]string `yaml:"env"`
+	HealthCheck healthCheck       `yaml:"health_check"`
+}
+
+func manifestAllowed(rep Repo, section string) bool {
+	if len(rep.ManifestAllow) == 0 {
+		return true
+	}
+
+	for _, allow := range rep.ManifestAllow {
+		if strings.TrimSpace(allow) == section {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadManifest 从待部署的提交中读取 .code-get.yml，并按服务器配置过滤和覆盖
+func loadManifest(repoName string, rep Repo, r *git.Repository, hash plumbing.Hash) (*manifest, error) {
+	if !rep.Manifest {
+		return nil, nil
+	}
+
+	commit, err := r.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := commit.File(manifestName)
+	if err == object.ErrFileNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(manifest)
+	if err := yaml.UnmarshalStrict([]byte(content), m); err != nil {
+		return nil, fmt.Errorf("%s 格式错误: %v", manifestName, err)
+	}
+
+	for _, section := range manifestSections {
+		if manifestAllowed(rep, section) {
+			continue
+		}
+
+		logger(repoName).Printf("%s 中的 %s 未被服务器配置允许，已忽略\n", manifestName, section)
+		switch section {
+		case "build":
+			m.Build = nil
+		case "shared":
+			m.Shared = nil
+		case "env":
+			m.Env = nil
+		case "health_check":
+			m.HealthCheck = healthCheck{}
+		}
+	}
+
+	if len(rep.HealthCheck) != 0 {
+		m.HealthCheck.URL = rep.HealthCheck
+	}
+
+	return m, nil
+}
+
+func (m *manifest) linkShared(repoName string, rep Repo) error {
+	l := logger(repoName)
+
+	sharedPath := rep.SharedPath
+	if len(sharedPath) == 0 {
+		sharedPath = filepath.Join(GetSettings().SharedDir, repoName)
+	}
+
+	for _, name := range m.Shared {
+		// 以 / 结尾的是目录，不存在时自动创建；文件（如 .env）需要事先在共享目录中准备好
+		isDir := strings.HasSuffix(name, "/")
+		name = filepath.Clean(name)
+		if filepath.IsAbs(name) || name == "." || strings.HasPrefix(name, "..") {
+			return fmt.Errorf("共享目录 %s 不合法", name)
+		}
+
+		source := filepath.Join(sharedPath, name)
+		if _, err := os.Stat(source); os.IsNotExist(err) && isDir {
+			if err := os.MkdirAll(source, 0755); err != nil {
+				return err
+			}
+		} else if os.IsNotExist(err) {
+			return fmt.Errorf("共享文件 %s 不存在，请先创建；目录请在清单中以 / 结尾", source)
+		} else if err != nil {
+			return err
+		}
+
+		// 清单和仓库中的符号链接都来自仓库，删除前确认上级目录实际在部署目录中
+		target := filepath.Join(rep.Path, name)
+		if err := mkdirWithin(rep.Path, filepath.Dir(target)); err != nil {
+			return fmt.Errorf("共享目录 %s 不合法: %v", name, err)
+		}
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		if err := os.Symlink(source, target); err != nil {
+			return err
+		}
+
+		l.Printf("共享目录: %s -> %s\n", target, source)
+	}
+
+	return nil
+}
+
+func (m *manifest) runBuild(repoName string, rep Repo, hash plumbing.Hash) error {
+	l := logger(repoName)
+
+	env := append(os.Environ(),
+		"BRANCH="+rep.Branch,
+		"WORK_PATH="+rep.Path,
+		"REPOS="+repoName,
+		"COMMIT="+hash.String(),
+	)
+	for k, v := range m.Env {
+		env = append(env, k+"="+v)
+	}
+
+	for _, command := range m.Build {
+		l.Printf("构建: %s\n", command)
+
+		cmd := exec.Command("bash", "-e", "-c", command)
+		cmd.Dir = rep.Path
+		cmd.Env = env
+
+		data, err := cmd.CombinedOutput()
+		l.Println(string(data))
+
+		if err != nil {
+			return fmt.Errorf("构建命令 %q 失败: %v", command, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *manifest) checkHealth(repoName string) error {
+	check := m.HealthCheck
+	if len(check.URL) == 0 {
+		return nil
+	}
+
+	if check.Timeout <= 0 {
+		check.Timeout = 10
+	}
+	if check.Retries <= 0 {
+		check.Retries = 3
+	}
+
+	client := &http.Client{Timeout: time.Duration(check.Timeout) * time.Second}
+
+	var err error
+	for i := 0; i < check.Retries; i++ {
+		if i > 0 {
+			time.Sleep(2 * time.Second)
+		}
+
+		var resp *http.Response
+		resp, err = client.Get(check.URL)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 400 {
+			logger(repoName).Printf("健康检查通过: %s\n", check.URL)
+			return nil
+		}
+		err = fmt.Errorf("状态码 %d", resp.StatusCode)
+	}
+
+	return fmt.Errorf("健康检查 %s 失败: %v", check.URL, err)
+}
+
+// apply 在工作区切换到新提交后执行清单中的部署步骤
+func (m *manifest) apply(repoName string, rep Repo, hash plumbing.Hash) error {
+	if err := m.linkShared(repoName, rep); err != nil {
+		return err
+	}
+
+	if err := m.runBuild(repoName, rep, hash); err != nil {
+		return err
+	}
+
+	return m.checkHealth(repoName)
+}
@@ -0,0 +1,64 @@
+package github
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+)
+
+func TestLinkSharedSymlinkEscape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "code-get-manifest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 仓库中提交了指向部署目录以外的符号链接 storage
+	outside := filepath.Join(dir, "outside")
+	if err := os.MkdirAll(filepath.Join(outside, "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	rep := Repo{Path: filepath.Join(dir, "site"), SharedPath: filepath.Join(dir, "shared")}
+	if err := os.MkdirAll(rep.Path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(rep.Path, "storage")); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &manifest{Shared: []string{"storage/logs/"}}
+	if err := m.linkShared("site", rep); err == nil {
+		t.Error("经过仓库中的符号链接的共享目录应该被拒绝")
+	}
+
+	info, err := os.Lstat(filepath.Join(outside, "logs"))
+	if err != nil || !info.IsDir() {
+		t.Errorf("部署目录以外的 logs 被删除或替换: %v", err)
+	}
+}
+
+func TestLinkShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "code-get-manifest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rep := Repo{Path: filepath.Join(dir, "site"), SharedPath: filepath.Join(dir, "shared")}
+	if err := os.MkdirAll(filepath.Join(rep.Path, "storage", "logs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &manifest{Shared: []string{"storage/logs/"}}
+	if err := m.linkShared("site", rep); err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := os.Readlink(filepath.Join(rep.Path, "storage", "logs"))
+	if err != nil || link != filepath.Join(rep.SharedPath, "storage", "logs") {
+		t.Errorf("storage/logs 指向 %q %v", link, err)
+	}
+}
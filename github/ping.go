@@ -2,7 +2,12 @@ package github
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	. "github.com/xiaosumay/server-code-mgr/utils"
@@ -155,20 +160,165 @@ type pingPayload struct {
 	} `json:"sender"`
 }
 
-func PingEvent(data []byte) bool {
-	var ping pingPayload
-	err := json.Unmarshal(data, &ping)
+// PingResult 是收到 ping 事件时对项目和 webhook 配置的检查结果，作为响应返回，
+// 在 GitHub webhook 的 Recent Deliveries 中可以直接看到
+type PingResult struct {
+	Repo          string   `json:"repo"`
+	RepoMatched   bool     `json:"repo_matched"`
+	Branch        string   `json:"branch,omitempty"`
+	DefaultBranch string   `json:"default_branch,omitempty"`
+	Events        []string `json:"events"`
+	ContentType   string   `json:"content_type"`
+	KeyReadable   bool     `json:"key_readable"`
+	PathWritable  bool     `json:"path_writable"`
+	Cloning       bool     `json:"cloning"`
+	Problems      []string `json:"problems"`
+}
+
+// requiredEvents 返回项目的配置需要 webhook 发送的事件，每一项中的事件满足一个即可
+func requiredEvents(rep Repo) [][]string {
+	var events [][]string
+
+	if len(rep.ReleaseAsset) != 0 {
+		events = append(events, []string{"release"})
+	} else {
+		events = append(events, []string{"push"})
+	}
+	if rep.Previews {
+		events = append(events, []string{"pull_request"})
+	}
+	if rep.RequireCI {
+		events = append(events, []string{"status", "check_suite", "workflow_run"})
+	}
+
+	return events
+}
+
+// HookEvents 返回为项目创建 webhook 时需要订阅的事件
+func HookEvents(rep Repo) []string {
+	var events []string
+	for _, group := range requiredEvents(rep) {
+		events = append(events, group...)
+	}
+	return events
+}
+
+// credentialsReadable 检查拉取代码使用的私钥或令牌文件是否可读
+func credentialsReadable(rep Repo) error {
+	var file string
+	switch rep.Auth {
+	case "", "key":
+		file = KeyPath(rep.Key)
+	case "token", "basic":
+		file = rep.TokenFile
+	default:
+		return nil
+	}
+
+	f, err := os.Open(file)
 	if err != nil {
-		log.Println(err)
-		return false
+		return err
+	}
+	return f.Close()
+}
+
+// writable 检查能否在 dir 中创建文件，dir 不存在时检查最近的上级目录
+func writable(dir string) error {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
 	}
 
-	repoName := ping.Repository.Name
+	f, err := ioutil.TempFile(dir, ".code-get-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// PingEvent 检查 ping 事件对应的项目和 webhook 的配置，没有问题时克隆项目
+func PingEvent(data []byte) (PingResult, error) {
+	var ping pingPayload
+	if err := json.Unmarshal(data, &ping); err != nil {
+		return PingResult{}, err
+	}
+
+	result := PingResult{
+		Repo:          ping.Repository.Name,
+		DefaultBranch: ping.Repository.DefaultBranch,
+		Events:        ping.Hook.Events,
+		ContentType:   ping.Hook.Config.ContentType,
+		Problems:      []string{},
+	}
+	problem := func(format string, a ...interface{}) {
+		result.Problems = append(result.Problems, fmt.Sprintf(format, a...))
+	}
+
+	rep, ok := GetRepo(result.Repo)
+	if !ok {
+		problem("配置文件中没有项目 %s", result.Repo)
+		return result, nil
+	}
+	result.RepoMatched = true
+	result.Branch = rep.Branch
+
+	// webhook 以表单格式发送时无法解析事件内容
+	if result.ContentType != "json" {
+		problem("webhook 的 Content type 是 %q，需要设置为 application/json", result.ContentType)
+	}
+
+	subscribed := make(map[string]bool)
+	for _, event := range ping.Hook.Events {
+		subscribed[event] = true
+	}
+	if !subscribed["*"] {
+		for _, events := range requiredEvents(rep) {
+			found := false
+			for _, event := range events {
+				found = found || subscribed[event]
+			}
+			if !found {
+				problem("webhook 没有发送 %s 事件", strings.Join(events, " 或 "))
+			}
+		}
+	}
+
+	if len(rep.ReleaseAsset) != 0 {
+		// release 部署的项目不需要拉取代码
+		result.KeyReadable = true
+	} else if err := credentialsReadable(rep); err != nil {
+		problem("拉取代码的凭据不可读: %v", err)
+	} else {
+		result.KeyReadable = true
+	}
+
+	// 项目目录可能还不存在，release 部署时会替换项目目录本身
+	dir := rep.Path
+	if len(rep.ReleaseAsset) != 0 {
+		dir = filepath.Dir(rep.Path)
+	}
+	if err := writable(dir); err != nil {
+		problem("部署目录 %s 不可写: %v", rep.Path, err)
+	} else {
+		result.PathWritable = true
+	}
+
+	if len(result.Problems) != 0 {
+		log.Printf("项目 %s 的 webhook 配置有问题: %s\n", result.Repo, strings.Join(result.Problems, "；"))
+		return result, nil
+	}
 
-	if repo, ok := Repositories[repoName]; ok {
-		go CloneRepos(repoName, repo)
-		return true
+	if len(rep.ReleaseAsset) == 0 {
+		result.Cloning = true
+		go CloneRepos(result.Repo, rep)
 	}
 
-	return false
+	return result, nil
 }
@@ -0,0 +1,26 @@
+package github
+
+import (
+	"reflect"
+	"testing"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+)
+
+func TestHookEvents(t *testing.T) {
+	tests := []struct {
+		rep  Repo
+		want []string
+	}{
+		{Repo{}, []string{"push"}},
+		{Repo{Previews: true}, []string{"push", "pull_request"}},
+		{Repo{RequireCI: true}, []string{"push", "status", "check_suite", "workflow_run"}},
+		{Repo{ReleaseAsset: "app-*.tar.gz"}, []string{"release"}},
+	}
+
+	for _, test := range tests {
+		if got := HookEvents(test.rep); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("HookEvents(%+v) = %v，应为 %v", test.rep, got, test.want)
+		}
+	}
+}
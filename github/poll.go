@@ -0,0 +1,117 @@
+package github
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+)
+
+// maxPollBackoff 是轮询连续出错时等待时间的上限
+const maxPollBackoff = time.Hour
+
+var (
+	pollLock sync.Mutex
+	polling  = make(map[string]bool)
+)
+
+// StartPolling 为配置了 poll_interval 的项目定时检查远程分支，
+// 用于收不到 webhook 的服务器。重新加载配置后新增的项目也会开始轮询
+func StartPolling() {
+	rand.Seed(time.Now().UnixNano())
+
+	go func() {
+		for {
+			for name, rep := range Repositories() {
+				if rep.PollInterval > 0 {
+					startPoller(name)
+				}
+			}
+			time.Sleep(MinPollInterval)
+		}
+	}()
+}
+
+func startPoller(repoName string) {
+	pollLock.Lock()
+	defer pollLock.Unlock()
+
+	if polling[repoName] {
+		return
+	}
+	polling[repoName] = true
+
+	go poll(repoName)
+}
+
+// jitter 在 d 上随机增减最多 10%，避免多个项目同时访问远程仓库
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d / 10)
+	if spread <= 0 {
+		return d
+	}
+	return d - time.Duration(spread) + time.Duration(rand.Int63n(2*spread))
+}
+
+// pollDelay 返回下一次轮询前的等待时间，连续出错时按指数退避
+func pollDelay(interval time.Duration, failures int) time.Duration {
+	delay := interval
+	for i := 0; i < failures && delay < maxPollBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxPollBackoff && interval < maxPollBackoff {
+		delay = maxPollBackoff
+	}
+	return jitter(delay)
+}
+
+// poll 定时比较远程分支和部署目录的提交，不一致时请求部署。
+// 项目被移除或不再配置 poll_interval 时退出
+func poll(repoName string) {
+	defer func() {
+		pollLock.Lock()
+		delete(polling, repoName)
+		pollLock.Unlock()
+	}()
+
+	rep, ok := GetRepo(repoName)
+	if !ok || rep.PollInterval <= 0 {
+		return
+	}
+
+	log.Printf("项目 %s 每 %s 检查一次远程分支\n", repoName, rep.PollInterval)
+
+	// 第一次检查的时间随机分散在一个轮询间隔内
+	time.Sleep(time.Duration(rand.Int63n(int64(rep.PollInterval))))
+
+	failures := 0
+	var requested string
+
+	for {
+		rep, ok := GetRepo(repoName)
+		if !ok || rep.PollInterval <= 0 {
+			log.Printf("项目 %s 停止轮询\n", repoName)
+			return
+		}
+
+		head, err := RemoteHead(rep)
+		if err != nil {
+			failures++
+			log.Printf("项目 %s 检查远程分支失败（第 %d 次）: %v\n", repoName, failures, err)
+		} else {
+			failures = 0
+
+			// 部署失败时不反复重试同一个提交，等远程分支有新的提交
+			remote := head.String()
+			if remote != LocalHead(rep.Path) && remote != requested {
+				log.Printf("项目 %s 远程分支 %s 有新的提交 %s\n", repoName, rep.Branch, remote)
+				requested = remote
+				Submit(repoName, rep, Request{Commit: remote})
+			}
+		}
+
+		time.Sleep(pollDelay(rep.PollInterval, failures))
+	}
+}
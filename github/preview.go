@@ -0,0 +1,256 @@
+package github
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+)
+
+const ActionPreview = "preview"
+
+type pullRequestPayload struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Head struct {
+			Ref  string `json:"ref"`
+			SHA  string `json:"sha"`
+			Repo struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"head"`
+	} `json:"pull_request"`
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// Preview 是一个拉取请求的预览环境，按项目记录在 state_dir/previews/<项目名>.json 中
+type Preview struct {
+	Number  int       `json:"number"`
+	Branch  string    `json:"branch"`
+	Commit  string    `json:"commit"`
+	Path    string    `json:"path"`
+	Updated time.Time `json:"updated"`
+}
+
+var previewLock sync.Mutex
+
+func previewFile(repoName string) string {
+	return filepath.Join(GetSettings().StateDir, "previews", repoName+".json")
+}
+
+func loadPreviews(repoName string) (map[int]Preview, error) {
+	previews := make(map[int]Preview)
+
+	data, err := ioutil.ReadFile(previewFile(repoName))
+	if os.IsNotExist(err) {
+		return previews, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &previews); err != nil {
+		return nil, fmt.Errorf("预览记录 %s 格式错误: %v", previewFile(repoName), err)
+	}
+	return previews, nil
+}
+
+func savePreviews(repoName string, previews map[int]Preview) error {
+	file := previewFile(repoName)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(previews, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// previewName 是预览在部署历史和日志中使用的名称
+func previewName(repoName string, number int) string {
+	return fmt.Sprintf("%s-pr-%d", repoName, number)
+}
+
+// previewPath 按 preview_path 模板生成预览的部署目录
+func previewPath(repoName string, rep Repo, number int) string {
+	return strings.NewReplacer(
+		"{name}", repoName,
+		"{owner}", rep.Owner,
+		"{number}", strconv.Itoa(number),
+	).Replace(rep.PreviewPath)
+}
+
+// PullRequestEvent 为开启了 previews 的项目部署拉取请求的预览，拉取请求关闭时删除预览。
+// 来自 fork 的拉取请求不部署，避免运行未经审核的代码
+func PullRequestEvent(data []byte) bool {
+	var pr pullRequestPayload
+	if err := json.Unmarshal(data, &pr); err != nil {
+		log.Println(err)
+		return false
+	}
+
+	repoName := pr.Repository.Name
+	rep, ok := GetRepo(repoName)
+	if !ok || !rep.Previews {
+		log.Printf("项目 %s 没有开启预览\n", repoName)
+		return false
+	}
+
+	head := pr.PullRequest.Head
+
+	switch pr.Action {
+	case "opened", "reopened", "synchronize":
+		if head.Repo.FullName != pr.Repository.FullName {
+			log.Printf("项目 %s 的拉取请求 #%d 来自 %s，不部署预览\n", repoName, pr.Number, head.Repo.FullName)
+			return false
+		}
+		if !ValidBranchName(head.Ref) {
+			log.Printf("项目 %s 的拉取请求 #%d 分支名 %q 不合法\n", repoName, pr.Number, head.Ref)
+			return false
+		}
+
+		go deployPreview(repoName, rep, pr.Number, head.Ref, head.SHA)
+	case "closed":
+		go removePreview(repoName, pr.Number)
+	}
+
+	return true
+}
+
+// deployPreview 把拉取请求的提交部署到预览目录，预览数达到 max_previews 时不部署新的预览
+func deployPreview(repoName string, rep Repo, number int, branch, commit string) {
+	CleanPreviews()
+
+	name := previewName(repoName, number)
+	path := previewPath(repoName, rep, number)
+
+	previewLock.Lock()
+	previews, err := loadPreviews(repoName)
+	if err != nil {
+		previewLock.Unlock()
+		log.Println(err)
+		return
+	}
+
+	if _, ok := previews[number]; !ok && rep.MaxPreviews > 0 && len(previews) >= rep.MaxPreviews {
+		previewLock.Unlock()
+		log.Printf("项目 %s 已有 %d 个预览，达到 max_previews，拉取请求 #%d 不部署预览\n", repoName, len(previews), number)
+		return
+	}
+
+	previews[number] = Preview{
+		Number:  number,
+		Branch:  branch,
+		Commit:  commit,
+		Path:    path,
+		Updated: time.Now(),
+	}
+	err = savePreviews(repoName, previews)
+	previewLock.Unlock()
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	preview := rep
+	preview.Path = path
+	preview.Branch = branch
+	// 预览不能使用正式环境的共享目录
+	preview.SharedPath = path + ".shared"
+
+	d := record(name, preview, ActionPreview, func() error {
+		return DoReposUpdate(name, preview, Request{Commit: commit, Force: true})
+	})
+
+	if d.Status != StatusFailed {
+		log.Printf("项目 %s 拉取请求 #%d 的预览已部署到 %s\n", repoName, number, path)
+	}
+}
+
+// removePreview 删除拉取请求的预览，只删除记录中的目录
+func removePreview(repoName string, number int) {
+	lock := repoLock(previewName(repoName, number))
+	lock.Lock()
+	defer lock.Unlock()
+
+	previewLock.Lock()
+	previews, err := loadPreviews(repoName)
+	if err != nil {
+		previewLock.Unlock()
+		log.Println(err)
+		return
+	}
+
+	preview, ok := previews[number]
+	if ok {
+		delete(previews, number)
+		err = savePreviews(repoName, previews)
+	}
+	previewLock.Unlock()
+
+	if !ok {
+		return
+	}
+	if err != nil {
+		log.Println(err)
+	}
+
+	for _, path := range []string{preview.Path, preview.Path + ".shared"} {
+		if err := os.RemoveAll(path); err != nil {
+			log.Println(err)
+		}
+	}
+
+	log.Printf("项目 %s 拉取请求 #%d 的预览已删除: %s\n", repoName, number, preview.Path)
+}
+
+// CleanPreviews 删除超过 preview_ttl 没有更新的预览
+func CleanPreviews() {
+	for repoName, rep := range Repositories() {
+		if !rep.Previews || rep.PreviewTTL <= 0 {
+			continue
+		}
+
+		previewLock.Lock()
+		previews, err := loadPreviews(repoName)
+		previewLock.Unlock()
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		for number, preview := range previews {
+			if time.Since(preview.Updated) > rep.PreviewTTL {
+				log.Printf("项目 %s 拉取请求 #%d 的预览超过 %s 没有更新\n", repoName, number, rep.PreviewTTL)
+				removePreview(repoName, number)
+			}
+		}
+	}
+}
+
+// StartPreviewCleanup 每小时清理一次过期的预览
+func StartPreviewCleanup() {
+	go func() {
+		for {
+			CleanPreviews()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
@@ -198,10 +198,23 @@ func PushEvent(data []byte) bool {
 
 	repoName := push.Repository.Name
 
-	if repo, ok := utils.Repositories[repoName]; ok {
+	if repo, ok := utils.GetRepo(repoName); ok {
 		ref := "refs/heads/" + repo.Branch
 		if push.Ref == ref {
-			go DoReposUpdate(repoName, repo)
+			if len(repo.ReleaseAsset) != 0 {
+				log.Printf("项目 %s 通过 release 部署，忽略推送\n", repoName)
+				return true
+			}
+
+			switch {
+			case push.Deleted:
+				branchDeleted(repoName, repo)
+			case push.Forced:
+				forcePushed(repoName, repo, push.Before, push.After)
+			default:
+				// 部署推送的那个提交，而不是处理时分支的最新提交，避免之后的推送抢先
+				Submit(repoName, repo, Request{Commit: push.After})
+			}
 			return true
 		}
 	}
@@ -0,0 +1,46 @@
+package github
+
+import (
+	"sync"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+)
+
+var (
+	queueLock sync.Mutex
+	// pending 中是等待执行的部署请求，running 中的项目有协程在处理
+	pending = make(map[string]Request)
+	running = make(map[string]bool)
+)
+
+// Enqueue 请求部署项目。同一个项目同时只有一个部署在执行，
+// 执行期间的多次请求只保留最后一次，在当前部署结束后执行
+func Enqueue(repoName string, req Request) {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	pending[repoName] = req
+	if running[repoName] {
+		return
+	}
+	running[repoName] = true
+
+	go func() {
+		for {
+			queueLock.Lock()
+			req, ok := pending[repoName]
+			if !ok {
+				delete(running, repoName)
+				queueLock.Unlock()
+				return
+			}
+			delete(pending, repoName)
+			queueLock.Unlock()
+
+			// 每次部署时重新读取配置，使用最新的项目配置
+			if rep, ok := GetRepo(repoName); ok {
+				Deploy(repoName, rep, req)
+			}
+		}
+	}()
+}
@@ -0,0 +1,542 @@
+package github
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	gh "github.com/google/go-github/github"
+	. "github.com/xiaosumay/server-code-mgr/utils"
+)
+
+type releasePayload struct {
+	Action  string `json:"action"`
+	Release struct {
+		TagName    string `json:"tag_name"`
+		Draft      bool   `json:"draft"`
+		Prerelease bool   `json:"prerelease"`
+	} `json:"release"`
+	Repository struct {
+		Name string `json:"name"`
+	} `json:"repository"`
+}
+
+// ReleaseEvent 为配置了 release_asset 的项目部署新发布的 release，预发布版本不部署
+func ReleaseEvent(data []byte) bool {
+	var payload releasePayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		log.Println(err)
+		return false
+	}
+
+	repoName := payload.Repository.Name
+	rep, ok := GetRepo(repoName)
+	if !ok || len(rep.ReleaseAsset) == 0 {
+		log.Printf("项目 %s 没有配置 release_asset\n", repoName)
+		return false
+	}
+
+	release := payload.Release
+	if payload.Action != "published" || release.Draft {
+		return true
+	}
+	if release.Prerelease {
+		log.Printf("项目 %s 的 %s 是预发布版本，不部署\n", repoName, release.TagName)
+		return true
+	}
+
+	Enqueue(repoName, Request{Tag: release.TagName})
+	return true
+}
+
+// releaseCommit 返回标签指向的提交，没有配置 commit_status 或查询失败时返回空
+func releaseCommit(repoName string, rep Repo, tag string) string {
+	if len(rep.CommitStatus) == 0 || len(tag) == 0 {
+		return ""
+	}
+
+	token, err := APIToken("")
+	if err != nil {
+		log.Printf("项目 %s 无法查询标签 %s 的提交: %v\n", repoName, tag, err)
+		return ""
+	}
+
+	client, ctx, err := NewClient(token)
+	if err != nil {
+		log.Printf("项目 %s 无法查询标签 %s 的提交: %v\n", repoName, tag, err)
+		return ""
+	}
+
+	sha, _, err := client.Repositories.GetCommitSHA1(ctx, rep.Owner, repoName, "refs/tags/"+tag, "")
+	if err != nil {
+		log.Printf("项目 %s 查询标签 %s 的提交失败: %v\n", repoName, tag, err)
+		return ""
+	}
+	return sha
+}
+
+// releaseTag 返回 release 部署的项目当前的版本，即项目目录指向的 release 目录名
+func releaseTag(rep Repo) string {
+	target, err := os.Readlink(rep.Path)
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// findAsset 返回名称匹配 pattern 的第一个附件
+func findAsset(release *gh.RepositoryRelease, pattern string) (gh.ReleaseAsset, bool) {
+	for _, asset := range release.Assets {
+		if ok, _ := path.Match(pattern, asset.GetName()); ok {
+			return asset, true
+		}
+	}
+	return gh.ReleaseAsset{}, false
+}
+
+// downloadAsset 通过 API 下载附件，API 返回跳转地址时从跳转地址下载
+func downloadAsset(repoName string, rep Repo, asset gh.ReleaseAsset, w io.Writer) error {
+	token, err := APIToken("")
+	if err != nil {
+		return err
+	}
+
+	client, ctx, err := NewClient(token)
+	if err != nil {
+		return err
+	}
+
+	rc, redirect, err := client.Repositories.DownloadReleaseAsset(ctx, rep.Owner, repoName, asset.GetID())
+	if err != nil {
+		return fmt.Errorf("下载 %s 失败: %v", asset.GetName(), err)
+	}
+
+	if len(redirect) != 0 {
+		// 跳转地址是带签名的临时地址，不能带上 API 令牌
+		resp, err := (&http.Client{Timeout: 10 * time.Minute}).Get(redirect)
+		if err != nil {
+			return fmt.Errorf("下载 %s 失败: %v", asset.GetName(), err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("下载 %s 失败: %s", asset.GetName(), resp.Status)
+		}
+		rc = resp.Body
+	}
+	defer rc.Close()
+
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+// parseChecksums 解析 sha256sum 格式的校验文件，返回 name 的校验和。
+// 只有一个校验和、没有文件名的校验文件适用于任何附件
+func parseChecksums(data []byte, name string) (string, error) {
+	var single []string
+
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch len(fields) {
+		case 0:
+		case 1:
+			single = append(single, fields[0])
+		default:
+			if strings.TrimPrefix(fields[1], "*") == name {
+				return strings.ToLower(fields[0]), nil
+			}
+		}
+	}
+
+	if len(single) == 1 {
+		return strings.ToLower(single[0]), nil
+	}
+
+	return "", fmt.Errorf("校验文件中没有 %s 的校验和", name)
+}
+
+// within 判断 path 是否在 dir 中
+func within(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+// extractPath 返回压缩包中的文件在 dest 中的位置，拒绝跳出 dest 的路径
+func extractPath(dest, name string) (string, error) {
+	target := filepath.Join(dest, name)
+	if !within(dest, target) {
+		return "", fmt.Errorf("压缩包中的路径 %q 不合法", name)
+	}
+	return target, nil
+}
+
+// mkdirWithin 在 dest 中创建目录 dir。路径上已经存在的部分可能是不可信的符号链接
+// （压缩包中先解压出来的、仓库中提交的），按磁盘上实际指向的位置检查，不在 dest 中时拒绝
+func mkdirWithin(dest, dir string) error {
+	root, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+
+	existing := dir
+	for existing != dest {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+	if !within(root, real) {
+		return fmt.Errorf("路径 %s 经过符号链接指向 %s，超出了 %s", dir, real, dest)
+	}
+
+	return os.MkdirAll(dir, 0755)
+}
+
+// writeFile 在 dest 中创建新文件，不会写入已经存在的文件或符号链接
+func writeFile(dest, target string, mode os.FileMode, r io.Reader) error {
+	if err := mkdirWithin(dest, filepath.Dir(target)); err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(target); err == nil {
+		return fmt.Errorf("压缩包中的 %s 重复", target)
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeSymlink 创建压缩包中的符号链接，只允许指向 dest 中的相对路径。
+// 链接所在的目录和链接本身都按磁盘上实际指向的位置检查
+func writeSymlink(dest, target, link string) error {
+	if filepath.IsAbs(link) || !within(dest, filepath.Join(filepath.Dir(target), link)) {
+		return fmt.Errorf("压缩包中的符号链接 %s 指向 %s，超出了 release 目录", target, link)
+	}
+
+	if err := mkdirWithin(dest, filepath.Dir(target)); err != nil {
+		return err
+	}
+
+	root, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	if !within(root, filepath.Join(parent, link)) {
+		return fmt.Errorf("压缩包中的符号链接 %s 指向 %s，超出了 release 目录", target, link)
+	}
+
+	if err := os.Symlink(link, target); err != nil {
+		return err
+	}
+
+	// 链接中的 .. 可能经过其他符号链接
+	if real, err := filepath.EvalSymlinks(target); err == nil && !within(root, real) {
+		os.Remove(target)
+		return fmt.Errorf("压缩包中的符号链接 %s 指向 %s，超出了 release 目录", target, real)
+	}
+	return nil
+}
+
+func extractTar(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := extractPath(dest, header.Name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = mkdirWithin(dest, target)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeFile(dest, target, header.FileInfo().Mode(), tr)
+		case tar.TypeSymlink:
+			err = writeSymlink(dest, target, header.Linkname)
+		default:
+			// 忽略硬链接、设备文件等
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(file, dest string) error {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		target, err := extractPath(dest, f.Name)
+		if err != nil {
+			return err
+		}
+
+		mode := f.Mode()
+		if mode.IsDir() {
+			if err := mkdirWithin(dest, target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+
+		if mode&os.ModeSymlink != 0 {
+			var link []byte
+			link, err = ioutil.ReadAll(rc)
+			if err == nil {
+				err = writeSymlink(dest, target, string(link))
+			}
+		} else {
+			err = writeFile(dest, target, mode, rc)
+		}
+		rc.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractAsset 按附件的扩展名解压到 dest
+func extractAsset(file, name, dest string) error {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return extractZip(file, dest)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"), strings.HasSuffix(name, ".tar"):
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var r io.Reader = f
+		if !strings.HasSuffix(name, ".tar") {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+			r = gz
+		}
+		return extractTar(r, dest)
+	default:
+		return fmt.Errorf("不支持的附件格式 %s，只支持 .tar.gz、.tgz、.tar 和 .zip", name)
+	}
+}
+
+// switchRelease 把项目目录（符号链接）原子地切换到 dir
+func switchRelease(rep Repo, dir string) error {
+	if info, err := os.Lstat(rep.Path); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("项目目录 %s 不是符号链接，请先移走原来的部署", rep.Path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(rep.Path), 0755); err != nil {
+		return err
+	}
+
+	link := rep.Path + ".new"
+	os.Remove(link)
+	if err := os.Symlink(dir, link); err != nil {
+		return err
+	}
+
+	return os.Rename(link, rep.Path)
+}
+
+// pruneReleases 只保留最近的 keep_releases 个 release 目录，当前版本不会被删除
+func pruneReleases(repoName string, rep Repo) {
+	if rep.KeepReleases <= 0 {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(rep.ReleaseDir)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var dirs []os.FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") && entry.Name() != releaseTag(rep) {
+			dirs = append(dirs, entry)
+		}
+	}
+
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].ModTime().After(dirs[j].ModTime())
+	})
+
+	// 当前版本占一个名额
+	for i := rep.KeepReleases - 1; i < len(dirs); i++ {
+		dir := filepath.Join(rep.ReleaseDir, dirs[i].Name())
+		if err := os.RemoveAll(dir); err != nil {
+			log.Println(err)
+			continue
+		}
+		logger(repoName).Printf("删除旧的 release 目录 %s\n", dir)
+	}
+}
+
+// deployRelease 下载 release 中的附件，校验后解压到 release_dir/<标签>，再把项目目录切换过去。
+// tag 为空时部署最新的 release
+func deployRelease(repoName string, rep Repo, req Request) error {
+	l := logger(repoName)
+
+	token, err := APIToken("")
+	if err != nil {
+		return err
+	}
+
+	client, ctx, err := NewClient(token)
+	if err != nil {
+		return err
+	}
+
+	var release *gh.RepositoryRelease
+	if len(req.Tag) == 0 {
+		release, _, err = client.Repositories.GetLatestRelease(ctx, rep.Owner, repoName)
+	} else {
+		release, _, err = client.Repositories.GetReleaseByTag(ctx, rep.Owner, repoName, req.Tag)
+	}
+	if err != nil {
+		return fmt.Errorf("获取 release 失败: %v", err)
+	}
+
+	tag := release.GetTagName()
+	if !ValidBranchName(tag) || strings.Contains(tag, "/") {
+		return fmt.Errorf("release 标签 %q 不能作为目录名", tag)
+	}
+
+	// 不能覆盖正在使用的目录，同一个版本不重复部署
+	if tag == releaseTag(rep) {
+		l.Printf("%s 已经部署\n", tag)
+		return nil
+	}
+
+	asset, ok := findAsset(release, rep.ReleaseAsset)
+	if !ok {
+		return fmt.Errorf("release %s 中没有匹配 %s 的附件", tag, rep.ReleaseAsset)
+	}
+	sums, ok := findAsset(release, rep.ReleaseChecksum)
+	if !ok {
+		return fmt.Errorf("release %s 中没有匹配 %s 的校验文件", tag, rep.ReleaseChecksum)
+	}
+
+	if err := os.MkdirAll(rep.ReleaseDir, 0755); err != nil {
+		return err
+	}
+
+	var checksums strings.Builder
+	if err := downloadAsset(repoName, rep, sums, &checksums); err != nil {
+		return err
+	}
+	want, err := parseChecksums([]byte(checksums.String()), asset.GetName())
+	if err != nil {
+		return err
+	}
+
+	l.Printf("下载 %s 的 %s\n", tag, asset.GetName())
+
+	file := filepath.Join(rep.ReleaseDir, ".download-"+tag)
+	defer os.Remove(file)
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	err = downloadAsset(repoName, rep, asset, io.MultiWriter(f, hash))
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+		return fmt.Errorf("%s 的 sha256 校验和 %s 与校验文件中的 %s 不一致", asset.GetName(), got, want)
+	}
+	l.Println("校验通过")
+
+	tmp := filepath.Join(rep.ReleaseDir, ".extract-"+tag)
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+
+	// 没有顶层目录时 tmp 就是 release 目录，需要 web 服务可读
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+
+	if err := extractAsset(file, asset.GetName(), tmp); err != nil {
+		return fmt.Errorf("解压 %s 失败: %v", asset.GetName(), err)
+	}
+
+	// 压缩包中只有一个顶层目录时以它为 release 目录
+	root := tmp
+	if entries, err := ioutil.ReadDir(tmp); err == nil && len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(tmp, entries[0].Name())
+	}
+
+	dir := filepath.Join(rep.ReleaseDir, tag)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(root, dir); err != nil {
+		return err
+	}
+
+	if err := switchRelease(rep, dir); err != nil {
+		return err
+	}
+	l.Printf("%s 已切换到 %s\n", rep.Path, dir)
+
+	pruneReleases(repoName, rep)
+	return nil
+}
@@ -0,0 +1,288 @@
+package github
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/xiaosumay/server-code-mgr/utils"
+)
+
+type tarEntry struct {
+	name string
+	link string
+	body string
+}
+
+// makeTar 生成压缩包，link 不为空的是符号链接，其余是文件
+func makeTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+		if len(e.link) != 0 {
+			header = &tar.Header{Name: e.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: e.link}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// extractTest 把压缩包解压到临时目录中的 releases/v1，返回临时目录和解压的结果
+func extractTest(t *testing.T, entries []tarEntry) (string, string, error) {
+	base, err := ioutil.TempDir("", "code-get-release-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(base, "releases", "v1")
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return base, dest, extractTar(makeTar(t, entries), dest)
+}
+
+// outside 返回 base 中 dest 以外的文件
+func outside(t *testing.T, base, dest string) []string {
+	var files []string
+	filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dest {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files
+}
+
+func TestExtractTarSymlinkEscape(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"经过符号链接的符号链接", []tarEntry{
+			{name: "sub/l", link: ".."},
+			{name: "sub/l/m", link: ".."},
+			{name: "sub/l/m/evil", body: "evil"},
+		}},
+		{"链接中的 .. 经过符号链接", []tarEntry{
+			{name: "sub/l", link: ".."},
+			{name: "up", link: "sub/l/.."},
+			{name: "up/evil", body: "evil"},
+		}},
+		{"经过符号链接的目录", []tarEntry{
+			{name: "sub/l", link: ".."},
+			{name: "sub/l/m", link: ".."},
+			{name: "sub/l/m/dir/evil", body: "evil"},
+		}},
+		{"覆盖符号链接", []tarEntry{
+			{name: "sub/f", body: "a"},
+			{name: "f", link: "sub/f"},
+			{name: "f", body: "evil"},
+		}},
+	}
+
+	for _, test := range tests {
+		base, dest, err := extractTest(t, test.entries)
+		if err == nil {
+			t.Errorf("%s: 解压应该失败", test.name)
+		}
+		if files := outside(t, base, dest); len(files) != 0 {
+			t.Errorf("%s: 在 release 目录以外写入了 %v", test.name, files)
+		}
+		if data, _ := ioutil.ReadFile(filepath.Join(dest, "sub", "f")); string(data) == "evil" {
+			t.Errorf("%s: 通过符号链接覆盖了 sub/f", test.name)
+		}
+		os.RemoveAll(base)
+	}
+}
+
+func TestExtractTarSymlink(t *testing.T) {
+	base, dest, err := extractTest(t, []tarEntry{
+		{name: "app/bin/run", body: "#!/bin/sh"},
+		{name: "app/current", link: "bin"},
+		{name: "app/current/config", body: "ok"},
+	})
+	defer os.RemoveAll(base)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dest, "app", "bin", "config"))
+	if err != nil || string(data) != "ok" {
+		t.Errorf("通过 release 目录中的符号链接解压失败: %q %v", data, err)
+	}
+}
+
+func TestReleaseCommitStatus(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+
+	var statuses []string
+	var state string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/acme/site/commits/refs/tags/v1.0":
+			fmt.Fprint(w, sha)
+		case r.Method == http.MethodPost:
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			statuses = append(statuses, r.URL.Path)
+			state = body["state"]
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{}`)
+		default:
+			// release 不存在，部署失败
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"Not Found"}`)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "code-get-release-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "repositories.conf")
+	data := fmt.Sprintf("api_url = %s/\nhtml_dir = %s\nstate_dir = %s\n\n[site]\nowner = acme\nrelease_asset = site-*.tar.gz\ncommit_status = github\n",
+		server.URL, filepath.Join(dir, "html"), filepath.Join(dir, "state"))
+	if err := ioutil.WriteFile(config, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("GITHUB_AUTH_TOKEN", "tok")
+	defer os.Unsetenv("GITHUB_AUTH_TOKEN")
+	ParseConfig(config)
+
+	rep, _ := GetRepo("site")
+	if d := Deploy("site", rep, Request{Tag: "v1.0"}); d.Status != StatusFailed {
+		t.Fatalf("部署结果 = %s，应为 %s", d.Status, StatusFailed)
+	}
+
+	want := "/repos/acme/site/statuses/" + sha
+	if len(statuses) != 1 || statuses[0] != want || state != "failure" {
+		t.Errorf("提交状态 = %v (%s)，应为 %s (failure)", statuses, state, want)
+	}
+}
+
+// fakeRelease 是提供 release v1.0 的 GitHub API 替身，附件是 tarball 和 SHA256SUMS，
+// SHA256SUMS 通过跳转地址下载
+func fakeRelease(t *testing.T, tarball []byte) *httptest.Server {
+	sums := fmt.Sprintf("%x  site-v1.0.tar.gz\n", sha256.Sum256(tarball))
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/acme/site/releases/tags/v1.0":
+			fmt.Fprint(w, `{"tag_name":"v1.0","assets":[{"id":1,"name":"site-v1.0.tar.gz"},{"id":2,"name":"SHA256SUMS"}]}`)
+		case "/repos/acme/site/releases/assets/1":
+			w.Write(tarball)
+		case "/repos/acme/site/releases/assets/2":
+			http.Redirect(w, r, server.URL+"/download/SHA256SUMS", http.StatusFound)
+		case "/download/SHA256SUMS":
+			if len(r.Header.Get("Authorization")) != 0 {
+				t.Error("跳转地址不应带上 API 令牌")
+			}
+			fmt.Fprint(w, sums)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"Not Found"}`)
+		}
+	}))
+	return server
+}
+
+func gzipTar(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := makeTar(t, entries).WriteTo(gz); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDeployRelease(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"有顶层目录", []tarEntry{{name: "site-v1.0/index.html", body: "v1.0"}}},
+		{"没有顶层目录", []tarEntry{{name: "index.html", body: "v1.0"}}},
+	}
+
+	for _, test := range tests {
+		server := fakeRelease(t, gzipTar(t, test.entries))
+
+		dir, err := ioutil.TempDir("", "code-get-release-")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config := filepath.Join(dir, "repositories.conf")
+		data := fmt.Sprintf("api_url = %s/\nhtml_dir = %s\nstate_dir = %s\n\n[site]\nowner = acme\nrelease_asset = site-*.tar.gz\n",
+			server.URL, filepath.Join(dir, "html"), filepath.Join(dir, "state"))
+		if err := ioutil.WriteFile(config, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		os.Setenv("GITHUB_AUTH_TOKEN", "tok")
+		ParseConfig(config)
+
+		rep, _ := GetRepo("site")
+		d := Deploy("site", rep, Request{Tag: "v1.0"})
+		if d.Status != StatusSuccess {
+			t.Errorf("%s: 部署结果 = %s (%s)", test.name, d.Status, d.Error)
+		}
+
+		if tag := releaseTag(rep); tag != "v1.0" {
+			t.Errorf("%s: 项目目录指向 %q，应为 v1.0", test.name, tag)
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(rep.Path, "index.html")); err != nil || string(data) != "v1.0" {
+			t.Errorf("%s: index.html = %q %v", test.name, data, err)
+		}
+		if info, err := os.Stat(rep.Path); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if info.Mode().Perm() != 0755 {
+			t.Errorf("%s: release 目录的权限是 %v，应为 0755", test.name, info.Mode().Perm())
+		}
+
+		// 下载和解压的临时文件已经清理
+		if left, _ := filepath.Glob(filepath.Join(rep.ReleaseDir, ".*")); len(left) != 0 {
+			t.Errorf("%s: 没有清理临时文件 %v", test.name, left)
+		}
+
+		server.Close()
+		os.RemoveAll(dir)
+	}
+	os.Unsetenv("GITHUB_AUTH_TOKEN")
+}
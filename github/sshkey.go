@@ -0,0 +1,75 @@
+package github
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+const opensshMagic = "openssh-key-v1\x00"
+
+var errWrongPassphrase = errors.New("私钥密码错误")
+
+type opensshKey struct {
+	CipherName   string
+	KdfName      string
+	KdfOpts      string
+	NumKeys      uint32
+	PubKey       []byte
+	PrivKeyBlock []byte
+}
+
+// parsePrivateKey 解析私钥，passphrase 非空时支持 PEM 加密和 OpenSSH 格式加密的私钥
+func parsePrivateKey(data, passphrase []byte) (interface{}, error) {
+	if len(passphrase) == 0 {
+		return ssh.ParseRawPrivateKey(data)
+	}
+
+	key, err := ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+	if err == x509.IncorrectPasswordError {
+		return nil, errWrongPassphrase
+	}
+	return key, err
+}
+
+// marshalED25519 按 OpenSSH 格式编码 ed25519 私钥，这是 ssh 唯一认可的 ed25519 私钥格式
+func marshalED25519(key ed25519.PrivateKey, comment string) ([]byte, error) {
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, err
+	}
+	check := binary.BigEndian.Uint32(buf[:])
+
+	priv := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+	}{check, check, ssh.KeyAlgoED25519, []byte(key.Public().(ed25519.PublicKey)), []byte(key), comment})
+
+	for i := 1; len(priv)%8 != 0; i++ {
+		priv = append(priv, byte(i))
+	}
+
+	data := append([]byte(opensshMagic), ssh.Marshal(opensshKey{
+		CipherName:   "none",
+		KdfName:      "none",
+		NumKeys:      1,
+		PubKey:       pub.Marshal(),
+		PrivKeyBlock: priv,
+	})...)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: data}), nil
+}
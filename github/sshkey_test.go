@@ -0,0 +1,76 @@
+package github
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 测试用的私钥由 ssh-keygen 生成，密码保存在 testdata/passphrase 中
+var encryptedKeys = []string{
+	"ed25519_encrypted",
+	"rsa_encrypted",
+	"ecdsa_encrypted",
+	"ecdsa_pem_encrypted",
+	"rsa_pem_encrypted",
+}
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// authorizedKey 返回公钥文件中去掉注释的部分
+func authorizedKey(data []byte) string {
+	fields := strings.Fields(string(data))
+	return fields[0] + " " + fields[1]
+}
+
+func TestParsePrivateKeyEncrypted(t *testing.T) {
+	passphrase := bytes.TrimRight(readTestdata(t, "passphrase"), "\n")
+
+	for _, name := range encryptedKeys {
+		t.Run(name, func(t *testing.T) {
+			key, err := parsePrivateKey(readTestdata(t, name), passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signer, err := ssh.NewSignerFromKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := authorizedKey(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+			want := authorizedKey(readTestdata(t, name+".pub"))
+			if got != want {
+				t.Errorf("公钥不一致:\n got %s\nwant %s", got, want)
+			}
+		})
+	}
+}
+
+func TestParsePrivateKeyWrongPassphrase(t *testing.T) {
+	for _, name := range encryptedKeys {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parsePrivateKey(readTestdata(t, name), []byte("wrong")); err == nil {
+				t.Error("错误的密码没有返回错误")
+			}
+		})
+	}
+}
+
+func TestParsePrivateKeyWithoutPassphrase(t *testing.T) {
+	if _, err := parsePrivateKey(readTestdata(t, "ed25519_encrypted"), nil); err == nil {
+		t.Error("没有密码时加密的私钥应该解析失败")
+	}
+}
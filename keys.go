@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/xiaosumay/server-code-mgr/github"
+	"github.com/xiaosumay/server-code-mgr/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+func keysUsage() {
+	fmt.Fprintln(os.Stderr, "用法: code-get keys generate [-c 配置文件] [-fingerprint] [-force] <项目名>")
+	fmt.Fprintln(os.Stderr, "      code-get keys rotate [-c 配置文件] <项目名>")
+}
+
+// keyRepo 返回项目配置，配置中没有的项目按全局配置生成默认的私钥路径
+func keyRepo(name string) utils.Repo {
+	if repo, ok := utils.GetRepo(name); ok {
+		return repo
+	}
+	return utils.Repo{Key: filepath.Join(utils.GetSettings().KeyDir, name)}
+}
+
+func printPublicKey(pub ssh.PublicKey, comment string, fingerprint bool) {
+	authorized := ssh.MarshalAuthorizedKey(pub)
+	fmt.Printf("%s %s\n", authorized[:len(authorized)-1], comment)
+	if fingerprint {
+		fmt.Println(ssh.FingerprintSHA256(pub))
+	}
+}
+
+func renameKey(from, to string) error {
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	if _, err := os.Stat(from + ".pub"); err == nil {
+		return os.Rename(from+".pub", to+".pub")
+	}
+	return nil
+}
+
+// keysCommand 处理 keys 子命令，返回进程退出码
+func keysCommand(args []string) int {
+	if len(args) == 0 {
+		keysUsage()
+		return 2
+	}
+
+	var fs *flag.FlagSet
+	fingerprint, force := new(bool), new(bool)
+	switch args[0] {
+	case "generate":
+		fs = newFlagSet("keys generate", "keys generate [-c 配置文件] [-fingerprint] [-force] <项目名>",
+			"生成项目的部署私钥并输出公钥，私钥已存在时需要 -force 才会覆盖。")
+		fs.BoolVar(fingerprint, "fingerprint", false, "同时输出公钥指纹")
+		fs.BoolVar(force, "force", false, "覆盖已存在的私钥")
+	case "rotate":
+		fs = newFlagSet("keys rotate", "keys rotate [-c 配置文件] <项目名>",
+			"更换项目的部署私钥。第一次执行生成新私钥 <私钥>.new，把输出的公钥添加为部署 key 后再次执行，\n新私钥测试拉取成功后才会替换旧私钥，旧私钥保存为 <私钥>.old。")
+	default:
+		keysUsage()
+		return 2
+	}
+	path := fs.String("c", defaultConfig, "配置文件")
+	if err := fs.Parse(args[1:]); err != nil {
+		return flagError(err)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	if !loadConfig(*path) {
+		return 2
+	}
+
+	name := fs.Arg(0)
+	repo := keyRepo(name)
+	keyPath := utils.KeyPath(repo.Key)
+	comment := "code-get@" + name
+
+	switch args[0] {
+	case "generate":
+		if _, err := os.Stat(keyPath); err == nil && !*force {
+			fmt.Fprintf(os.Stderr, "私钥 %s 已存在，更换私钥请使用 keys rotate\n", keyPath)
+			return 1
+		}
+
+		pub, err := github.GenerateKey(keyPath, comment)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		fmt.Printf("私钥已写入 %s\n", keyPath)
+		printPublicKey(pub, comment, *fingerprint)
+		return 0
+	case "rotate":
+		newPath := keyPath + ".new"
+
+		if _, err := os.Stat(newPath); err != nil {
+			pub, err := github.GenerateKey(newPath, comment)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+
+			fmt.Printf("新私钥已写入 %s，旧私钥保持不变\n", newPath)
+			printPublicKey(pub, comment, true)
+			fmt.Printf("请把上面的公钥添加为部署 key，然后再次执行 code-get keys rotate %s\n", name)
+			return 0
+		}
+
+		test := repo
+		test.Key = newPath
+		test.KeyPassphraseFile = ""
+
+		if _, err := github.RemoteHead(test); err != nil {
+			fmt.Fprintf(os.Stderr, "新私钥 %s 测试拉取失败，旧私钥保持不变: %v\n", newPath, err)
+			return 1
+		}
+
+		if _, err := os.Stat(keyPath); err == nil {
+			if err := renameKey(keyPath, keyPath+".old"); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+
+		if err := renameKey(newPath, keyPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		fmt.Printf("已切换到新私钥 %s，旧私钥保存在 %s.old，确认无误后请删除旧的部署 key\n", keyPath, keyPath)
+		if len(repo.KeyPassphraseFile) != 0 {
+			fmt.Println("新私钥没有密码，可以删除配置中的 key_passphrase_file")
+		}
+		return 0
+	default:
+		keysUsage()
+		return 2
+	}
+}
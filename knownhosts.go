@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/xiaosumay/server-code-mgr/github"
+	"github.com/xiaosumay/server-code-mgr/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+func knownHostsUsage() {
+	fmt.Fprintln(os.Stderr, "用法: code-get known-hosts add [-c 配置文件] [-f known_hosts] [-y] <主机[:端口]|项目名>")
+}
+
+// knownHostsCommand 处理 known-hosts 子命令，首次连接时需要人工确认主机公钥指纹
+func knownHostsCommand(args []string) int {
+	if len(args) == 0 || args[0] != "add" {
+		knownHostsUsage()
+		return 2
+	}
+
+	fs := newFlagSet("known-hosts add", "known-hosts add [-c 配置文件] [-f known_hosts] [-y] <主机[:端口]|项目名>",
+		"获取主机的 SSH 公钥，确认指纹后写入 known_hosts。参数是项目名时使用项目 remote_path 中的主机和项目的 known_hosts。")
+	path := fs.String("c", defaultConfig, "配置文件")
+	file := fs.String("f", "", "known_hosts 文件，默认使用配置中的 known_hosts")
+	yes := fs.Bool("y", false, "不询问，直接信任")
+	if err := fs.Parse(args[1:]); err != nil {
+		return flagError(err)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	if _, err := os.Stat(*path); err == nil && !loadConfig(*path) {
+		return 2
+	}
+
+	addr := fs.Arg(0)
+	knownHosts := utils.GetSettings().KnownHosts
+
+	if repo, ok := utils.GetRepo(addr); ok {
+		host, err := github.RemoteHost(repo.RemotePath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		addr, knownHosts = host, github.KnownHostsFile(repo)
+	}
+
+	if *file != "" {
+		knownHosts = *file
+	}
+
+	key, err := github.ScanHostKey(addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "无法获取 %s 的公钥: %v\n", addr, err)
+		return 1
+	}
+
+	fmt.Printf("%s %s %s\n", github.HostAddr(addr), key.Type(), ssh.FingerprintSHA256(key))
+
+	known, err := github.KnownHost(knownHosts, addr, key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s 中登记的公钥与主机不一致，请确认主机是否更换过密钥: %v\n", knownHosts, err)
+		return 1
+	}
+	if known {
+		fmt.Printf("已在 %s 中登记\n", knownHosts)
+		return 0
+	}
+
+	if !*yes {
+		fmt.Print("确认信任该主机？(y/N) ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			fmt.Println("已取消")
+			return 1
+		}
+	}
+
+	if err := github.AddKnownHost(knownHosts, addr, key); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("已写入 %s\n", knownHosts)
+	return 0
+}
@@ -4,49 +4,198 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
 
+	"github.com/xiaosumay/server-code-mgr/admin"
 	"github.com/xiaosumay/server-code-mgr/github"
 	"github.com/xiaosumay/server-code-mgr/utils"
 )
 
+const defaultConfig = "/etc/code-get/repositories.conf"
+
 var (
 	SecretToken string
 	Version     string
 
-	configPath = flag.String("c", "/etc/code-get/repositories.conf", "配置文件")
-	debug      = flag.Bool("debug", false, "调试模式，不验证token")
-	update     = flag.Bool("u", false, "手动更新所有代码")
-	token      = flag.String("token", SecretToken, "webhook的安全token")
-	port       = flag.Int("port", 17293, "监听端口")
+	// hookToken 是项目没有配置 secret 时校验 webhook 签名的 token
+	hookToken string
 )
 
+func usage() {
+	fmt.Fprintln(os.Stderr, `用法: code-get <命令> [参数]
+
+命令:
+  serve         启动 webhook 服务
+  deploy        部署项目
+  status        查看项目当前的版本和最近一次部署
+  history       查看部署历史
+  pending       查看等待 CI 通过的部署
+  rollback      回滚到之前部署的版本
+  config        检查或转换配置文件
+  known-hosts   登记远程仓库的主机公钥
+  keys          生成或更换部署 key
+  onboard       接入新项目
+  admin         通过 GitHub API 管理仓库
+
+使用 code-get <命令> -h 查看命令的参数。
+退出码: 0 成功，1 执行失败，2 参数错误。
+
+不带命令时兼容旧的用法:
+  code-get [-c 配置文件] [-u] [-debug] [-token token] [-port 端口] [-watch]`)
+}
+
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(command(os.Args[1], os.Args[2:]))
+	}
+
+	os.Exit(legacyCommand(os.Args[1:]))
+}
+
+func command(name string, args []string) int {
+	switch name {
+	case "serve":
+		return serveCommand(args)
+	case "deploy":
+		return deployCommand(args)
+	case "status":
+		return statusCommand(args)
+	case "history":
+		return historyCommand(args)
+	case "rollback":
+		return rollbackCommand(args)
+	case "pending":
+		return pendingCommand(args)
+	case "config":
+		return configCommand(args)
+	case "known-hosts":
+		return knownHostsCommand(args)
+	case "keys":
+		return keysCommand(args)
+	case "onboard":
+		return onboardCommand(args)
+	case "admin":
+		return admin.Run(args)
+	case "help":
+		usage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "未知的命令 %s\n\n", name)
+		usage()
+		return 2
+	}
+}
+
+// newFlagSet 创建子命令的参数，-h 时输出用法、说明和参数列表
+func newFlagSet(name, synopsis, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "用法: code-get %s\n\n%s\n\n参数:\n", synopsis, description)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// flagError 把参数解析的错误转换为退出码，-h 不算错误
+func flagError(err error) int {
+	if err == flag.ErrHelp {
+		return 0
+	}
+	return 2
+}
+
+// loadConfig 加载 -c 指定的配置文件，失败时输出原因，调用方以参数错误退出
+func loadConfig(path string) bool {
+	if err := utils.LoadConfig(path); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+// printJSON 以 JSON 格式输出，供 --json 使用
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// legacyCommand 兼容旧版本的参数：-u 部署所有项目，否则启动服务
+func legacyCommand(args []string) int {
+	fs := flag.NewFlagSet("code-get", flag.ContinueOnError)
+	fs.Usage = usage
+	configPath := fs.String("c", defaultConfig, "配置文件")
+	debug := fs.Bool("debug", false, "调试模式，不验证token")
+	update := fs.Bool("u", false, "手动更新所有代码")
+	token := fs.String("token", SecretToken, "webhook的安全token")
+	port := fs.Int("port", 17293, "监听端口")
+	watch := fs.Bool("watch", false, "配置文件变化时自动重新加载")
+	if err := fs.Parse(args); err != nil {
+		return flagError(err)
+	}
+
+	if *update {
+		return deployCommand([]string{"-c", *configPath})
+	}
+
+	return serve(*configPath, *debug, *token, *port, *watch)
+}
+
+func serveCommand(args []string) int {
+	fs := newFlagSet("serve", "serve [-c 配置文件] [-port 端口] [-token token] [-watch] [-debug]",
+		"启动 webhook 服务，收到推送后部署对应的项目。SIGHUP 重新加载配置。")
+	configPath := fs.String("c", defaultConfig, "配置文件")
+	debug := fs.Bool("debug", false, "调试模式，不验证token")
+	token := fs.String("token", SecretToken, "webhook的安全token，项目配置了 secret 时使用项目的")
+	port := fs.Int("port", 17293, "监听端口")
+	watch := fs.Bool("watch", false, "配置文件变化时自动重新加载")
+	if err := fs.Parse(args); err != nil {
+		return flagError(err)
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	return serve(*configPath, *debug, *token, *port, *watch)
+}
+
+func serve(configPath string, debug bool, token string, port int, watch bool) int {
 	log.SetFlags(log.LstdFlags)
 	log.Println(Version)
 
-	flag.Parse()
-
-	utils.Debug = *debug
+	utils.Debug = debug
+	hookToken = token
 
 	http.HandleFunc("/", HandleFunc)
 
-	utils.ParseConfig(*configPath)
+	if !loadConfig(configPath) {
+		return 2
+	}
+	utils.ReloadOnSignal(configPath)
+	github.StartPolling()
+	github.StartPreviewCleanup()
+	github.StartCIWatch()
 
-	if *update {
-		for name, repo := range utils.Repositories {
-			github.DoReposUpdate(name, repo)
+	if watch {
+		if err := utils.WatchConfig(configPath); err != nil {
+			log.Println(err)
 		}
-		return
 	}
 
-	err := http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", *port), nil)
+	err := http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", port), nil)
 	log.Println(err)
+	return 1
 }
 
 func HandleFunc(writer http.ResponseWriter, request *http.Request) {
@@ -56,6 +205,14 @@ func HandleFunc(writer http.ResponseWriter, request *http.Request) {
 		log.Println(err)
 	}
 
+	// 表单格式的 webhook 把事件内容放在 payload 字段中，解析出来用于查找密钥和 ping 的诊断
+	payload := data
+	if strings.HasPrefix(request.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if values, err := url.ParseQuery(string(data)); err == nil && values.Get("payload") != "" {
+			payload = []byte(values.Get("payload"))
+		}
+	}
+
 	signature := request.Header.Get("X-Hub-Signature")
 
 	if len(signature) == 0 {
@@ -65,7 +222,7 @@ func HandleFunc(writer http.ResponseWriter, request *http.Request) {
 	}
 
 	if !utils.Debug {
-		mac := hmac.New(sha1.New, []byte(*token))
+		mac := hmac.New(sha1.New, []byte(hookSecret(payload)))
 		_, _ = mac.Write(data)
 		expectedMAC := hex.EncodeToString(mac.Sum(nil))
 
@@ -80,19 +237,68 @@ func HandleFunc(writer http.ResponseWriter, request *http.Request) {
 
 	switch strings.ToLower(event) {
 	case "ping":
-		if github.PingEvent(data) {
-			writer.WriteHeader(http.StatusOK)
-			writer.Write([]byte("连接成功"))
-			return
+		result, err := github.PingEvent(payload)
+		if err != nil {
+			log.Println(err)
+			break
+		}
+
+		// 配置有问题时返回 400，GitHub 会把这次投递标记为失败
+		writer.Header().Set("Content-Type", "application/json")
+		if len(result.Problems) != 0 {
+			writer.WriteHeader(http.StatusBadRequest)
 		}
+		json.NewEncoder(writer).Encode(result)
+		return
 	case "push":
 		if github.PushEvent(data) {
 			writer.WriteHeader(http.StatusOK)
 			writer.Write([]byte("更新成功"))
 			return
 		}
+	case "status", "check_suite", "workflow_run":
+		if github.CIEvent(strings.ToLower(event), data) {
+			writer.WriteHeader(http.StatusOK)
+			writer.Write([]byte("已收到"))
+			return
+		}
+	case "release":
+		if github.ReleaseEvent(data) {
+			writer.WriteHeader(http.StatusOK)
+			writer.Write([]byte("已收到"))
+			return
+		}
+	case "deployment":
+		if github.DeploymentEvent(data) {
+			writer.WriteHeader(http.StatusOK)
+			writer.Write([]byte("已收到"))
+			return
+		}
+	case "pull_request":
+		if github.PullRequestEvent(data) {
+			writer.WriteHeader(http.StatusOK)
+			writer.Write([]byte("预览已处理"))
+			return
+		}
 	}
 
 	writer.WriteHeader(http.StatusInternalServerError)
 	writer.Write([]byte("无效操作"))
 }
+
+// hookSecret 返回校验签名用的 secret，项目配置了 secret 时优先使用
+func hookSecret(data []byte) string {
+	var payload struct {
+		Repository struct {
+			Name string `json:"name"`
+		} `json:"repository"`
+	}
+
+	if err := json.Unmarshal(data, &payload); err == nil {
+		if repo, ok := utils.GetRepo(payload.Repository.Name); ok && repo.Secret != "" {
+			return repo.Secret
+		}
+	}
+
+	return hookToken
+}
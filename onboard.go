@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xiaosumay/server-code-mgr/admin"
+	"github.com/xiaosumay/server-code-mgr/github"
+	"github.com/xiaosumay/server-code-mgr/utils"
+)
+
+// onboardSection 生成新项目的配置，只写入和全局配置不同的项
+func onboardSection(name, owner, path, branch, secret string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "\n[%s]\n", name)
+	if owner != utils.GetSettings().Owner {
+		fmt.Fprintf(&b, "owner = %s\n", owner)
+	}
+	if path != "" {
+		fmt.Fprintf(&b, "path = %s\n", path)
+	}
+	if branch != "" {
+		fmt.Fprintf(&b, "branch = %s\n", branch)
+	}
+	fmt.Fprintf(&b, "secret = %s\n", secret)
+
+	return b.String()
+}
+
+// appendSection 把配置追加到 file 末尾，返回恢复原文件的函数
+func appendSection(file, section string) (func(), error) {
+	old, err := ioutil.ReadFile(file)
+	existed := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if existed && len(old) != 0 && old[len(old)-1] != '\n' {
+		section = "\n" + section
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.WriteString(section); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if existed {
+			ioutil.WriteFile(file, old, 0640)
+		} else {
+			os.Remove(file)
+		}
+	}, nil
+}
+
+// onboardCommand 一次完成新项目的接入：生成部署 key 并添加到 GitHub、
+// 创建更新钩子、写入配置、克隆代码。任何一步失败都会撤销已完成的步骤
+func onboardCommand(args []string) int {
+	fs := newFlagSet("onboard", "onboard [-c 配置文件] [-o 写入的配置文件] [-path 部署目录] [-branch 分支] [-token 令牌] <owner/项目名>",
+		"接入新项目：生成部署 key 并添加到 GitHub、创建 webhook、写入配置、克隆代码。\n任何一步失败都会撤销已完成的步骤。")
+	path := fs.String("c", defaultConfig, "配置文件")
+	output := fs.String("o", "", "写入项目配置的文件，例如 conf.d/<项目名>.conf，默认追加到配置文件")
+	workPath := fs.String("path", "", "部署目录，默认为 html_dir/<项目名>")
+	branch := fs.String("branch", "", "部署的分支，默认为 default_branch")
+	token := fs.String("token", "", "GitHub 令牌，默认使用 GITHUB_AUTH_TOKEN 或 github_token_file")
+	if err := fs.Parse(args); err != nil {
+		return flagError(err)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	if !loadConfig(*path) {
+		return 2
+	}
+
+	owner, name := utils.GetSettings().Owner, fs.Arg(0)
+	if i := strings.Index(name, "/"); i >= 0 {
+		owner, name = name[:i], name[i+1:]
+	}
+	if owner == "" || name == "" {
+		fs.Usage()
+		return 2
+	}
+
+	if _, ok := utils.GetRepo(name); ok {
+		fmt.Fprintf(os.Stderr, "项目 %s 已在配置中\n", name)
+		return 1
+	}
+
+	file := utils.DefaultValue(*output, *path)
+	if ext := strings.ToLower(filepath.Ext(file)); ext == ".yml" || ext == ".yaml" {
+		fmt.Fprintf(os.Stderr, "不能向 YAML 配置 %s 追加项目，请用 -o 指定 ini 文件\n", file)
+		return 1
+	}
+
+	if *branch != "" && !utils.ValidBranchName(*branch) {
+		fmt.Fprintf(os.Stderr, "分支名 %s 不合法\n", *branch)
+		return 2
+	}
+
+	set := utils.GetSettings()
+	keyPath := utils.KeyPath(filepath.Join(set.KeyDir, name))
+	localPath := utils.DefaultValue(*workPath, filepath.Join(set.HtmlDir, name))
+
+	if _, err := os.Stat(keyPath); err == nil {
+		fmt.Fprintf(os.Stderr, "私钥 %s 已存在\n", keyPath)
+		return 1
+	}
+	if _, err := os.Stat(localPath); err == nil {
+		fmt.Fprintf(os.Stderr, "部署目录 %s 已存在\n", localPath)
+		return 1
+	}
+
+	url, err := admin.HookURL("")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	apiToken, err := github.APIToken(*token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	client, ctx, err := github.NewClient(apiToken)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var undo []func()
+	fail := func(step string, err error) int {
+		fmt.Fprintf(os.Stderr, "%s失败: %v\n", step, err)
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		fmt.Fprintln(os.Stderr, "已撤销之前的步骤")
+		return 1
+	}
+
+	comment := "code-get@" + name
+	pub, err := github.GenerateKey(keyPath, comment)
+	if err != nil {
+		return fail("生成私钥", err)
+	}
+	undo = append(undo, func() {
+		os.Remove(keyPath)
+		os.Remove(keyPath + ".pub")
+	})
+	fmt.Printf("已生成私钥 %s\n", keyPath)
+
+	key, err := admin.CreateDeployKey(client, ctx, owner, name, comment, github.AuthorizedKey(pub))
+	if err != nil {
+		return fail("添加部署 key", err)
+	}
+	undo = append(undo, func() {
+		if _, err := client.Repositories.DeleteKey(ctx, owner, name, key.GetID()); err != nil {
+			fmt.Fprintf(os.Stderr, "删除部署 key %d 失败: %v\n", key.GetID(), err)
+		}
+	})
+	fmt.Printf("已添加只读部署 key %d\n", key.GetID())
+
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return fail("生成 secret", err)
+	}
+	secret := hex.EncodeToString(buf)
+
+	restore, err := appendSection(file, onboardSection(name, owner, *workPath, *branch, secret))
+	if err != nil {
+		return fail("写入配置", err)
+	}
+	undo = append(undo, restore)
+
+	if err := utils.ReloadConfig(*path); err != nil {
+		return fail("重新加载配置", err)
+	}
+
+	repo, ok := utils.GetRepo(name)
+	if !ok {
+		return fail("写入配置", fmt.Errorf("%s 没有被配置文件 include", file))
+	}
+	fmt.Printf("已写入配置 %s\n", file)
+
+	// 钩子订阅的事件按写入后的项目配置（包括继承的全局配置）决定
+	hook, err := admin.CreateWebHook(client, ctx, owner, name, url, secret, github.HookEvents(repo))
+	if err != nil {
+		return fail("创建更新钩子", err)
+	}
+	undo = append(undo, func() {
+		if _, err := client.Repositories.DeleteHook(ctx, owner, name, hook.GetID()); err != nil {
+			fmt.Fprintf(os.Stderr, "删除更新钩子 %d 失败: %v\n", hook.GetID(), err)
+		}
+	})
+	fmt.Printf("已创建更新钩子 %d -> %s\n", hook.GetID(), url)
+
+	if err := github.CloneRepos(name, repo); err != nil {
+		os.RemoveAll(repo.Path)
+		return fail("克隆项目", err)
+	}
+
+	fmt.Printf("项目 %s 接入完成，重新加载服务的配置后生效\n", name)
+	return 0
+}
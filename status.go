@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/xiaosumay/server-code-mgr/github"
+	"github.com/xiaosumay/server-code-mgr/utils"
+)
+
+type repoStatus struct {
+	Repo       string             `json:"repo"`
+	Branch     string             `json:"branch"`
+	Path       string             `json:"path"`
+	Commit     string             `json:"commit,omitempty"`
+	LastDeploy *github.Deployment `json:"last_deploy,omitempty"`
+}
+
+func statusCommand(args []string) int {
+	fs := newFlagSet("status", "status [-c 配置文件] [--json] [项目名...]",
+		"查看项目部署目录当前的提交和最近一次部署的结果。")
+	configPath := fs.String("c", defaultConfig, "配置文件")
+	jsonOutput := fs.Bool("json", false, "以 JSON 格式输出")
+	if err := fs.Parse(args); err != nil {
+		return flagError(err)
+	}
+
+	if !loadConfig(*configPath) {
+		return 2
+	}
+
+	names, err := selectRepos(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	list := make([]repoStatus, 0, len(names))
+	for _, name := range names {
+		repo, _ := utils.GetRepo(name)
+
+		status := repoStatus{
+			Repo:   name,
+			Branch: repo.Branch,
+			Path:   repo.Path,
+			Commit: github.LocalHead(repo.Path),
+		}
+
+		history, err := github.History(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(history) != 0 {
+			status.LastDeploy = &history[0]
+		}
+
+		list = append(list, status)
+	}
+
+	if *jsonOutput {
+		printJSON(list)
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "项目\t分支\t提交\t最近部署\t状态\t部署目录")
+	for _, s := range list {
+		last, result := "-", "-"
+		if s.LastDeploy != nil {
+			last = s.LastDeploy.Start.Format("2006-01-02 15:04:05")
+			result = s.LastDeploy.Status
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Repo, s.Branch, shortHash(s.Commit), last, result, s.Path)
+	}
+	w.Flush()
+
+	return 0
+}
+
+func historyCommand(args []string) int {
+	fs := newFlagSet("history", "history [-c 配置文件] [-n 条数] [--json] [项目名...]",
+		"查看部署历史，最新的在前。每次部署的输出保存在 state_dir/logs 中。")
+	configPath := fs.String("c", defaultConfig, "配置文件")
+	limit := fs.Int("n", 20, "最多显示的条数，0 表示全部")
+	jsonOutput := fs.Bool("json", false, "以 JSON 格式输出")
+	if err := fs.Parse(args); err != nil {
+		return flagError(err)
+	}
+
+	if !loadConfig(*configPath) {
+		return 2
+	}
+
+	list, err := github.History(fs.Args()...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *limit > 0 && len(list) > *limit {
+		list = list[:*limit]
+	}
+
+	if *jsonOutput {
+		if list == nil {
+			list = []github.Deployment{}
+		}
+		printJSON(list)
+		return 0
+	}
+
+	printDeployments(list)
+	return 0
+}
+
+func pendingCommand(args []string) int {
+	fs := newFlagSet("pending", "pending [-c 配置文件] [--json]",
+		"查看配置了 require_ci 的项目中等待 CI 通过的部署。")
+	configPath := fs.String("c", defaultConfig, "配置文件")
+	jsonOutput := fs.Bool("json", false, "以 JSON 格式输出")
+	if err := fs.Parse(args); err != nil {
+		return flagError(err)
+	}
+
+	if !loadConfig(*configPath) {
+		return 2
+	}
+
+	list, err := github.PendingDeploys()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *jsonOutput {
+		if list == nil {
+			list = []github.PendingDeploy{}
+		}
+		printJSON(list)
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "项目\t提交\t等待时间\t超时")
+	for _, p := range list {
+		timeout := "-"
+		if repo, ok := utils.GetRepo(p.Repo); ok && repo.CITimeout > 0 {
+			timeout = p.Since.Add(repo.CITimeout).Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Repo, shortHash(p.Commit), time.Since(p.Since).Round(time.Second), timeout)
+	}
+	w.Flush()
+
+	return 0
+}
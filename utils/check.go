@@ -0,0 +1,252 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// ConfigError 描述配置文件中的一个问题，Section 和 Key 为空时表示整个文件的问题
+type ConfigError struct {
+	Section string `json:"section,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e ConfigError) Error() string {
+	switch {
+	case e.Section == "":
+		return e.Message
+	case e.Key == "":
+		return fmt.Sprintf("[%s] %s", e.Section, e.Message)
+	default:
+		return fmt.Sprintf("[%s] %s: %s", e.Section, e.Key, e.Message)
+	}
+}
+
+// iniKeys 返回结构体中所有可配置的键名
+func iniKeys(v interface{}) map[string]bool {
+	keys := make(map[string]bool)
+
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("ini"), ",")[0]
+		if name != "" && name != "-" {
+			keys[name] = true
+		}
+	}
+
+	return keys
+}
+
+// ValidBranchName 按 git check-ref-format 的规则检查分支名
+func ValidBranchName(name string) bool {
+	if name == "" || name == "@" ||
+		strings.HasPrefix(name, "-") ||
+		strings.HasPrefix(name, "/") ||
+		strings.HasSuffix(name, "/") ||
+		strings.HasSuffix(name, ".") ||
+		strings.HasSuffix(name, ".lock") ||
+		strings.Contains(name, "..") ||
+		strings.Contains(name, "@{") ||
+		strings.Contains(name, "//") {
+		return false
+	}
+
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(" ~^:?*[\\", r) {
+			return false
+		}
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckConfig 检查配置文件并返回发现的全部问题，没有问题时返回空
+func CheckConfig(configPath string) []ConfigError {
+	if _, err := os.Stat(configPath); err != nil {
+		return []ConfigError{{Message: fmt.Sprintf("配置文件不存在: %v", err)}}
+	}
+
+	cfg, _, err := openConfig(configPath)
+	if err != nil {
+		return []ConfigError{{Message: err.Error()}}
+	}
+
+	var problems []ConfigError
+	report := func(section, key, format string, a ...interface{}) {
+		problems = append(problems, ConfigError{section, key, fmt.Sprintf(format, a...)})
+	}
+
+	known := iniKeys(Repo{})
+	knownDefault := iniKeys(Settings{})
+	for key := range known {
+		knownDefault[key] = true
+	}
+
+	set, err := loadSettings(cfg)
+	if err != nil {
+		report(ini.DEFAULT_SECTION, "", "%v", err)
+	}
+
+	paths := make(map[string][]string)
+
+	for _, section := range cfg.Sections() {
+		name := section.Name()
+
+		for _, key := range section.Keys() {
+			if name == ini.DEFAULT_SECTION && knownDefault[key.Name()] {
+				continue
+			}
+			if !known[key.Name()] {
+				report(name, key.Name(), "未知的配置项")
+			}
+		}
+
+		if name == ini.DEFAULT_SECTION {
+			continue
+		}
+		if abstractSection(section) {
+			if section.HasKey("extends") {
+				// 父配置本身也可以继承，检查 extends 链是否正确
+				if _, err := repoFromSection(cfg, section, set); err != nil {
+					report(name, "", "%v", err)
+				}
+			}
+			continue
+		}
+
+		rep, err := repoFromSection(cfg, section, set)
+		if err != nil {
+			report(name, "", "%v", err)
+			continue
+		}
+
+		if len(rep.Script) != 0 && len(rep.Run) == 0 {
+			if _, err := scriptPath(rep.Script, set.ScriptDir); err != nil {
+				report(name, "script", "%v", err)
+			}
+		}
+
+		// release 部署的项目不访问 git 仓库
+		if len(rep.ReleaseAsset) == 0 {
+			switch rep.Auth {
+			case "", "key":
+				if _, err := os.Stat(keyPath(rep.Key, set.KeyDir)); err != nil {
+					report(name, "key", "私钥文件 %s 不可读: %v", keyPath(rep.Key, set.KeyDir), err)
+				}
+				if len(rep.KeyPassphraseFile) != 0 {
+					if _, err := os.Stat(rep.KeyPassphraseFile); err != nil {
+						report(name, "key_passphrase_file", "私钥密码文件 %s 不可读: %v", rep.KeyPassphraseFile, err)
+					}
+				}
+			case "agent":
+			case "token", "basic":
+				if !strings.HasPrefix(rep.RemotePath, "https://") {
+					report(name, "remote_path", "auth = %s 需要 https 地址", rep.Auth)
+				}
+				if rep.Auth == "basic" && len(rep.HttpUser) == 0 {
+					report(name, "http_user", "auth = basic 需要配置 http_user")
+				}
+				if _, err := os.Stat(rep.TokenFile); err != nil {
+					report(name, "token_file", "令牌文件 %q 不可读", rep.TokenFile)
+				}
+			default:
+				report(name, "auth", "不支持的认证方式 %q", rep.Auth)
+			}
+
+			knownHosts := DefaultValue(rep.KnownHosts, set.KnownHosts)
+			if !strings.HasPrefix(rep.RemotePath, "https://") {
+				if _, err := os.Stat(knownHosts); err != nil {
+					report(name, "known_hosts", "known_hosts 文件 %s 不存在，请先执行 code-get known-hosts add %s", knownHosts, name)
+				}
+			}
+		}
+
+		if !ValidBranchName(rep.Branch) {
+			report(name, "branch", "分支名 %q 不合法", rep.Branch)
+		}
+
+		for _, allow := range rep.ManifestAllow {
+			switch strings.TrimSpace(allow) {
+			case "build", "shared", "env", "health_check":
+			default:
+				report(name, "manifest_allow", "未知的清单部分 %q", allow)
+			}
+		}
+
+		if rep.Previews {
+			if len(rep.Run) != 0 || len(rep.Script) != 0 {
+				report(name, "previews", "使用自定义脚本部署的项目不支持预览")
+			}
+			if !strings.Contains(rep.PreviewPath, "{number}") {
+				report(name, "preview_path", "预览路径 %s 中必须包含 {number}", rep.PreviewPath)
+			}
+		}
+
+		switch rep.CommitStatus {
+		case "", "github", "gitlab":
+		case "gitea":
+			if len(set.GiteaURL) == 0 {
+				report(name, "commit_status", "commit_status = gitea 需要配置 gitea_url")
+			}
+		default:
+			report(name, "commit_status", "不支持的代码托管平台 %q", rep.CommitStatus)
+		}
+
+		if len(rep.ReleaseAsset) != 0 {
+			if len(rep.Run) != 0 || len(rep.Script) != 0 || rep.Previews || rep.PollInterval != 0 {
+				report(name, "release_asset", "release 部署的项目不能同时使用 run、script、previews 或 poll_interval")
+			}
+			if _, err := path.Match(rep.ReleaseAsset, ""); err != nil {
+				report(name, "release_asset", "匹配模式 %q 不合法", rep.ReleaseAsset)
+			}
+			if _, err := path.Match(rep.ReleaseChecksum, ""); err != nil {
+				report(name, "release_checksum", "匹配模式 %q 不合法", rep.ReleaseChecksum)
+			}
+		}
+
+		if rep.PollInterval != 0 && rep.PollInterval < MinPollInterval {
+			report(name, "poll_interval", "轮询间隔 %s 不合法，至少为 %s", rep.PollInterval, MinPollInterval)
+		}
+
+		path := filepath.Clean(rep.Path)
+		paths[path] = append(paths[path], name)
+
+		parent := filepath.Dir(path)
+		if info, err := os.Stat(parent); err != nil {
+			report(name, "path", "上级目录 %s 不存在", parent)
+		} else if !info.IsDir() {
+			report(name, "path", "上级目录 %s 不是目录", parent)
+		}
+	}
+
+	var duplicated []string
+	for path, names := range paths {
+		if len(names) > 1 {
+			duplicated = append(duplicated, path)
+		}
+	}
+	sort.Strings(duplicated)
+
+	for _, path := range duplicated {
+		names := paths[path]
+		for _, name := range names {
+			report(name, "path", "路径 %s 与 %s 重复", path, strings.Join(names, ", "))
+		}
+	}
+
+	return problems
+}
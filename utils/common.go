@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 )
@@ -12,10 +15,41 @@ func DefaultValue(val, fallback string) string {
 	return val
 }
 
+// KeyPath 返回私钥文件路径，不存在时到全局配置的 key_dir 下查找
+func KeyPath(key string) string {
+	return keyPath(key, GetSettings().KeyDir)
+}
+
+func keyPath(key, keyDir string) string {
+	if _, err := os.Stat(key); err != nil && !filepath.IsAbs(key) {
+		return filepath.Join(keyDir, key)
+	}
+	return key
+}
+
+// ScriptPath 返回部署脚本路径，不存在时到全局配置的 script_dir 下查找
+func ScriptPath(script string) (string, error) {
+	return scriptPath(script, GetSettings().ScriptDir)
+}
+
+func scriptPath(script, scriptDir string) (string, error) {
+	if _, err := os.Stat(script); err == nil {
+		return script, nil
+	} else if filepath.IsAbs(script) {
+		return "", fmt.Errorf("脚本 %s 不存在", script)
+	}
+
+	fallback := filepath.Join(scriptDir, script)
+	if _, err := os.Stat(fallback); err != nil {
+		return "", fmt.Errorf("脚本 %s 不存在", script)
+	}
+
+	return fallback, nil
+}
+
 var (
-	pattern      *regexp.Regexp
-	Repositories = make(map[string]Repo)
-	Debug        = false
+	pattern *regexp.Regexp
+	Debug   = false
 )
 
 func init() {
@@ -4,43 +4,315 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/ini.v1"
 )
 
+// MinPollInterval 是 poll_interval 允许的最小值，避免过于频繁地访问远程仓库
+const MinPollInterval = 10 * time.Second
+
+var (
+	reposLock    sync.RWMutex
+	settings     = defaultSettings()
+	repositories = make(map[string]Repo)
+)
+
+// Settings 是配置文件 [DEFAULT] 中的全局配置
+type Settings struct {
+	HtmlDir        string `ini:"html_dir,omitempty"`
+	KeyDir         string `ini:"key_dir,omitempty"`
+	ScriptDir      string `ini:"script_dir,omitempty"`
+	SharedDir      string `ini:"shared_dir,omitempty"`
+	RemoteTemplate string `ini:"remote_template,omitempty"`
+	Owner          string `ini:"owner,omitempty"`
+	DefaultBranch  string `ini:"default_branch,omitempty"`
+	KnownHosts     string `ini:"known_hosts,omitempty"`
+	StateDir       string `ini:"state_dir,omitempty"`
+	PreviewDir     string `ini:"preview_dir,omitempty"`
+
+	PublicURL       string `ini:"public_url,omitempty"`
+	APIURL          string `ini:"api_url,omitempty"`
+	GithubTokenFile string `ini:"github_token_file,omitempty"`
+	LogURL          string `ini:"log_url,omitempty"`
+
+	GitlabURL       string `ini:"gitlab_url,omitempty"`
+	GitlabTokenFile string `ini:"gitlab_token_file,omitempty"`
+	GiteaURL        string `ini:"gitea_url,omitempty"`
+	GiteaTokenFile  string `ini:"gitea_token_file,omitempty"`
+
+	Include []string `ini:"include,omitempty" delim:","`
+}
+
+func defaultSettings() Settings {
+	return Settings{
+		HtmlDir:        "/var/www/html",
+		KeyDir:         "/var/www/.ssh",
+		ScriptDir:      "/var/www/.scripts",
+		SharedDir:      "/var/www/shared",
+		StateDir:       "/var/lib/code-get",
+		PreviewDir:     "/var/www/previews",
+		RemoteTemplate: "git@github.com:{owner}/{name}.git",
+		Owner:          "MLTechMy",
+		DefaultBranch:  "master",
+		GitlabURL:      "https://gitlab.com",
+	}
+}
+
 type Repo struct {
+	Extends string `ini:"extends,omitempty"`
+	// Abstract 表示只作为 extends 的父配置，不是项目；不会被继承
+	Abstract bool `ini:"abstract,omitempty"`
+
+	Owner      string `ini:"owner,omitempty"`
 	Path       string `ini:"path,omitempty"`
 	Key        string `ini:"key,omitempty"`
 	Script     string `ini:"script,omitempty"`
+	Run        string `ini:"run,omitempty"`
 	Branch     string `ini:"branch,omitempty"`
 	RemotePath string `ini:"remote_path,omitempty"`
+	Secret     string `ini:"secret,omitempty"`
+
+	Auth              string `ini:"auth,omitempty"`
+	KeyPassphraseFile string `ini:"key_passphrase_file,omitempty"`
+	KnownHosts        string `ini:"known_hosts,omitempty"`
+	HttpUser          string `ini:"http_user,omitempty"`
+	TokenFile         string `ini:"token_file,omitempty"`
+
+	Manifest      bool     `ini:"manifest,omitempty"`
+	ManifestAllow []string `ini:"manifest_allow,omitempty" delim:","`
+	SharedPath    string   `ini:"shared_path,omitempty"`
+	HealthCheck   string   `ini:"health_check,omitempty"`
+
+	PollInterval time.Duration `ini:"poll_interval,omitempty"`
+
+	OnBranchDeleted string `ini:"on_branch_deleted,omitempty"`
+	AllowForce      bool   `ini:"allow_force,omitempty"`
+
+	Previews    bool          `ini:"previews,omitempty"`
+	PreviewPath string        `ini:"preview_path,omitempty"`
+	MaxPreviews int           `ini:"max_previews,omitempty"`
+	PreviewTTL  time.Duration `ini:"preview_ttl,omitempty"`
+
+	RequireCI  bool          `ini:"require_ci,omitempty"`
+	CITimeout  time.Duration `ini:"ci_timeout,omitempty"`
+	CIContexts []string      `ini:"ci_contexts,omitempty" delim:","`
+
+	Environment string `ini:"environment,omitempty"`
+
+	CommitStatus  string `ini:"commit_status,omitempty"`
+	StatusProject string `ini:"status_project,omitempty"`
+
+	ReleaseAsset    string `ini:"release_asset,omitempty"`
+	ReleaseChecksum string `ini:"release_checksum,omitempty"`
+	ReleaseDir      string `ini:"release_dir,omitempty"`
+	KeepReleases    int    `ini:"keep_releases,omitempty"`
 }
 
-func ParseConfig(configPath string) {
+func loadSettings(cfg *ini.File) (Settings, error) {
+	val := defaultSettings()
+
+	if err := cfg.Section(ini.DEFAULT_SECTION).MapTo(&val); err != nil {
+		return val, err
+	}
+
+	val.KnownHosts = DefaultValue(val.KnownHosts, filepath.Join(val.KeyDir, "known_hosts"))
+
+	return val, nil
+}
+
+// mapSection 按 [DEFAULT]、extends 链（从最上层开始）、当前项目的顺序依次覆盖配置
+func mapSection(cfg *ini.File, section *ini.Section, val *Repo, seen map[string]bool) error {
+	if seen[section.Name()] {
+		return fmt.Errorf("extends 循环引用: %s", section.Name())
+	}
+	seen[section.Name()] = true
+
+	if key, err := section.GetKey("extends"); err == nil && key.String() != "" {
+		parent, err := cfg.GetSection(key.String())
+		if err != nil || parent.Name() == ini.DEFAULT_SECTION {
+			return fmt.Errorf("extends 的项目 %s 不存在", key.String())
+		}
+
+		if err := mapSection(cfg, parent, val, seen); err != nil {
+			return err
+		}
+	}
+
+	return section.MapTo(val)
+}
+
+// abstractSection 判断配置项是否只作为 extends 的父配置，只看配置项自己的 abstract
+func abstractSection(section *ini.Section) bool {
+	if !section.HasKey("abstract") {
+		return false
+	}
+	return section.Key("abstract").MustBool(false)
+}
+
+func repoFromSection(cfg *ini.File, section *ini.Section, set Settings) (Repo, error) {
+	// 默认部署强制推送，allow_force = false 时拒绝
+	val := &Repo{
+		AllowForce:  true,
+		MaxPreviews: 5,
+		PreviewTTL:  7 * 24 * time.Hour,
+		CITimeout:   time.Hour,
+
+		ReleaseChecksum: "SHA256SUMS",
+		KeepReleases:    5,
+	}
+	name := section.Name()
+
+	if err := cfg.Section(ini.DEFAULT_SECTION).MapTo(val); err != nil {
+		return *val, err
+	}
+
+	if err := mapSection(cfg, section, val, make(map[string]bool)); err != nil {
+		return *val, err
+	}
+	val.Abstract = abstractSection(section)
+
+	val.Owner = DefaultValue(val.Owner, set.Owner)
+	val.Path = DefaultValue(val.Path, filepath.Join(set.HtmlDir, name))
+	val.RemotePath = DefaultValue(val.RemotePath, strings.NewReplacer(
+		"{name}", name,
+		"{owner}", val.Owner,
+	).Replace(set.RemoteTemplate))
+	val.Branch = DefaultValue(val.Branch, set.DefaultBranch)
+	val.Key = DefaultValue(val.Key, filepath.Join(set.KeyDir, name))
+	val.SharedPath = DefaultValue(val.SharedPath, filepath.Join(set.SharedDir, name))
+	val.PreviewPath = DefaultValue(val.PreviewPath, filepath.Join(set.PreviewDir, "{name}-pr-{number}"))
+	val.Environment = DefaultValue(val.Environment, "production")
+	val.StatusProject = DefaultValue(val.StatusProject, val.Owner+"/"+name)
+	val.ReleaseDir = DefaultValue(val.ReleaseDir, val.Path+".releases")
+
+	return *val, nil
+}
+
+func loadConfig(configPath string) (Settings, map[string]Repo, error) {
 	if _, err := os.Stat(configPath); err != nil {
-		log.Fatalln("请提供配置文件")
+		return Settings{}, nil, fmt.Errorf("请提供配置文件: %v", err)
+	}
+
+	cfg, _, err := openConfig(configPath)
+	if err != nil {
+		return Settings{}, nil, err
 	}
 
-	cfg, err := ini.Load(configPath)
+	set, err := loadSettings(cfg)
 	if err != nil {
-		log.Fatalln("配置文件出错2")
+		return set, nil, fmt.Errorf("全局配置出错: %v", err)
 	}
+	set.Include = includePatterns(configPath, cfg)
+
+	repos := make(map[string]Repo)
 
 	for _, section := range cfg.Sections() {
-		val := new(Repo)
+		//DEFAULT 中是全局配置和所有项目共用的配置，abstract 的配置项只供 extends，都不是项目
+		if section.Name() == ini.DEFAULT_SECTION || abstractSection(section) {
+			continue
+		}
 
-		err = section.MapTo(val)
+		val, err := repoFromSection(cfg, section, set)
 		if err != nil {
-			log.Fatalf("配置文件出错3: %v\n", err)
+			return set, nil, fmt.Errorf("配置项 [%s] 出错: %v", section.Name(), err)
 		}
 
-		val.Path = DefaultValue(val.Path, fmt.Sprintf("/var/www/html/%s", section.Name()))
-		val.RemotePath = DefaultValue(val.RemotePath, fmt.Sprintf("git@github.com/MLTechMy/%s.git", section.Name()))
-		val.Branch = DefaultValue(val.Branch, "master")
-		val.Key = DefaultValue(val.Key, fmt.Sprintf("/var/www/.ssh/%s", section.Name()))
+		repos[section.Name()] = val
+	}
 
-		Repositories[section.Name()] = *val
+	return set, repos, nil
+}
+
+func ParseConfig(configPath string) {
+	if err := LoadConfig(configPath); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// LoadConfig 与 ParseConfig 相同，配置文件不存在或有错误时返回错误而不是退出
+func LoadConfig(configPath string) error {
+	set, repos, err := loadConfig(configPath)
+	if err != nil {
+		return err
 	}
-	//当section空的时候的，一级配置不需要
-	delete(Repositories, "DEFAULT")
+
+	reposLock.Lock()
+	settings = set
+	repositories = repos
+	reposLock.Unlock()
+
+	return nil
+}
+
+// ReloadConfig 完整解析新配置，成功后才替换正在使用的配置，失败时保留旧配置
+func ReloadConfig(configPath string) error {
+	set, repos, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	reposLock.Lock()
+	oldSettings, old := settings, repositories
+	settings, repositories = set, repos
+	reposLock.Unlock()
+
+	changed := false
+	if !reflect.DeepEqual(oldSettings, set) {
+		log.Println("全局配置变更")
+		changed = true
+	}
+	for name, repo := range repos {
+		if prev, ok := old[name]; !ok {
+			log.Printf("配置新增: [%s]\n", name)
+			changed = true
+		} else if !reflect.DeepEqual(prev, repo) {
+			log.Printf("配置变更: [%s]\n", name)
+			changed = true
+		}
+	}
+	for name := range old {
+		if _, ok := repos[name]; !ok {
+			log.Printf("配置移除: [%s]\n", name)
+			changed = true
+		}
+	}
+
+	if !changed {
+		log.Println("配置未发生变化")
+	}
+
+	return nil
+}
+
+func GetSettings() Settings {
+	reposLock.RLock()
+	defer reposLock.RUnlock()
+
+	return settings
+}
+
+func GetRepo(name string) (Repo, bool) {
+	reposLock.RLock()
+	defer reposLock.RUnlock()
+
+	repo, ok := repositories[name]
+	return repo, ok
+}
+
+// Repositories 返回当前配置的一份拷贝
+func Repositories() map[string]Repo {
+	reposLock.RLock()
+	defer reposLock.RUnlock()
+
+	repos := make(map[string]Repo, len(repositories))
+	for name, repo := range repositories {
+		repos[name] = repo
+	}
+
+	return repos
 }
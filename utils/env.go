@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"gopkg.in/ini.v1"
+)
+
+var envPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// ExpandEnv 展开 ${VAR} 和 ${VAR:-default}，$$ 表示字面的 $。
+// 变量未设置又没有默认值时报错，避免生成不完整的路径。
+func ExpandEnv(s string) (string, error) {
+	var err error
+
+	expanded := envPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+
+		sub := envPattern.FindStringSubmatch(match)
+		if val, ok := os.LookupEnv(sub[1]); ok && (val != "" || sub[2] == "") {
+			return val
+		}
+		if sub[2] != "" {
+			return sub[3]
+		}
+
+		if err == nil {
+			err = fmt.Errorf("环境变量 %s 未设置", sub[1])
+		}
+		return ""
+	})
+
+	return expanded, err
+}
+
+// shellKeys 中的配置项是 shell 命令，其中的环境变量留给 shell 自己展开
+var shellKeys = map[string]bool{
+	"run":               true,
+	"on_branch_deleted": true,
+}
+
+// expandConfig 展开所有配置项中的环境变量，shell 命令除外
+func expandConfig(cfg *ini.File) error {
+	for _, section := range cfg.Sections() {
+		for _, key := range section.Keys() {
+			if shellKeys[key.Name()] {
+				continue
+			}
+
+			val, err := ExpandEnv(key.Value())
+			if err != nil {
+				return fmt.Errorf("[%s] %s: %v", section.Name(), key.Name(), err)
+			}
+			key.SetValue(val)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// includePatterns 返回主配置文件中 include 的通配符，相对路径以主配置文件所在目录为准
+func includePatterns(configPath string, cfg *ini.File) []string {
+	key, err := cfg.Section(ini.DEFAULT_SECTION).GetKey("include")
+	if err != nil {
+		return nil
+	}
+
+	var patterns []string
+	for _, pattern := range key.Strings(",") {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(configPath), pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns
+}
+
+// includeFiles 展开 include 的通配符，同一个通配符内按文件名排序，多个通配符按书写顺序
+func includeFiles(configPath string, patterns []string) ([]string, error) {
+	self, _ := filepath.Abs(configPath)
+	seen := map[string]bool{self: true}
+
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("include %s 不合法: %v", pattern, err)
+		}
+		sort.Strings(matches)
+
+		for _, file := range matches {
+			abs, _ := filepath.Abs(file)
+			if seen[abs] {
+				continue
+			}
+			seen[abs] = true
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
+
+// openConfig 读取主配置文件以及 include 的所有文件并合并，
+// 同名项目出现在多个文件中时报错，而不是静默合并
+func openConfig(configPath string) (*ini.File, []string, error) {
+	cfg, err := loadFile(configPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("配置文件 %s 解析失败: %v", configPath, err)
+	}
+	if err := expandConfig(cfg); err != nil {
+		return nil, nil, fmt.Errorf("配置文件 %s 出错: %v", configPath, err)
+	}
+
+	files, err := includeFiles(configPath, includePatterns(configPath, cfg))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	owners := make(map[string]string)
+	for _, name := range cfg.SectionStrings() {
+		owners[name] = configPath
+	}
+
+	for _, file := range files {
+		one, err := loadFile(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("配置文件 %s 解析失败: %v", file, err)
+		}
+		if err := expandConfig(one); err != nil {
+			return nil, nil, fmt.Errorf("配置文件 %s 出错: %v", file, err)
+		}
+
+		for _, section := range one.Sections() {
+			name := section.Name()
+			if name == ini.DEFAULT_SECTION {
+				if len(section.Keys()) != 0 {
+					return nil, nil, fmt.Errorf("配置文件 %s 中不能有全局配置: %s", file, strings.Join(section.KeyStrings(), ", "))
+				}
+				continue
+			}
+
+			if owner, ok := owners[name]; ok {
+				return nil, nil, fmt.Errorf("项目 [%s] 在 %s 和 %s 中重复定义", name, owner, file)
+			}
+			owners[name] = file
+
+			merged, err := cfg.NewSection(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, key := range section.Keys() {
+				if _, err := merged.NewKey(key.Name(), key.Value()); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	return cfg, files, nil
+}
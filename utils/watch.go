@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func reload(configPath string) {
+	log.Printf("重新加载配置文件: %s\n", configPath)
+
+	if err := ReloadConfig(configPath); err != nil {
+		log.Printf("配置文件重新加载失败，继续使用旧配置: %v\n", err)
+	}
+}
+
+// ReloadOnSignal 收到 SIGHUP 时重新加载配置文件
+func ReloadOnSignal(configPath string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	go func() {
+		for range sig {
+			reload(configPath)
+		}
+	}()
+}
+
+// WatchConfig 监听配置文件以及 include 的文件变化并自动重新加载。
+// 监听的是所在目录，这样编辑器先写临时文件再改名的保存方式也能被发现。
+func WatchConfig(configPath string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	absPath, err := filepath.Abs(configPath)
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+
+	if err := watcher.Add(filepath.Dir(absPath)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	watched := map[string]bool{filepath.Dir(absPath): true}
+
+	// include 可能在重新加载后发生变化，每次都按当前配置补充监听的目录
+	watchIncludes := func() {
+		for _, pattern := range GetSettings().Include {
+			dir, _ := filepath.Abs(filepath.Dir(pattern))
+			if watched[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				log.Printf("无法监听 %s: %v\n", dir, err)
+				continue
+			}
+			watched[dir] = true
+		}
+	}
+
+	relevant := func(name string) bool {
+		if name == absPath {
+			return true
+		}
+		for _, pattern := range GetSettings().Include {
+			pattern, _ = filepath.Abs(pattern)
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	watchIncludes()
+
+	go func() {
+		defer watcher.Close()
+
+		// 合并短时间内的多次写入，避免读到写了一半的文件
+		var timer <-chan time.Time
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !relevant(filepath.Clean(event.Name)) {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+					continue
+				}
+				timer = time.After(time.Second)
+			case <-timer:
+				timer = nil
+				reload(configPath)
+				watchIncludes()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println(err)
+			}
+		}
+	}()
+
+	return nil
+}
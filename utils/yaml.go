@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// yamlConfig 是 YAML 格式的配置文件，settings 对应 INI 中的 [DEFAULT]，
+// repositories 中每一项对应 INI 中的一个项目
+type yamlConfig struct {
+	Settings     yaml.MapSlice `yaml:"settings"`
+	Repositories yaml.MapSlice `yaml:"repositories"`
+}
+
+func isYAML(configPath string) bool {
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yml", ".yaml":
+		return true
+	}
+	return false
+}
+
+// loadFile 按扩展名读取单个配置文件，YAML 会被转换成与 INI 相同的结构
+func loadFile(configPath string) (*ini.File, error) {
+	if isYAML(configPath) {
+		return loadYAML(configPath)
+	}
+	return ini.Load(configPath)
+}
+
+func yamlValue(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		items := make([]string, 0, len(val))
+		for _, item := range val {
+			s, err := yamlValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case yaml.MapSlice, map[interface{}]interface{}:
+		return "", fmt.Errorf("不支持嵌套的配置")
+	default:
+		return fmt.Sprint(val), nil
+	}
+}
+
+func yamlSection(section *ini.Section, values yaml.MapSlice) error {
+	for _, item := range values {
+		key := fmt.Sprint(item.Key)
+
+		value, err := yamlValue(item.Value)
+		if err != nil {
+			return fmt.Errorf("[%s] %s: %v", section.Name(), key, err)
+		}
+
+		if _, err := section.NewKey(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loadYAML(configPath string) (*ini.File, error) {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf yamlConfig
+	if err := yaml.UnmarshalStrict(data, &conf); err != nil {
+		return nil, err
+	}
+
+	cfg := ini.Empty()
+
+	if err := yamlSection(cfg.Section(ini.DEFAULT_SECTION), conf.Settings); err != nil {
+		return nil, err
+	}
+
+	for _, item := range conf.Repositories {
+		name := fmt.Sprint(item.Key)
+
+		values, ok := item.Value.(yaml.MapSlice)
+		if !ok && item.Value != nil {
+			return nil, fmt.Errorf("项目 %s 的配置格式错误", name)
+		}
+
+		section, err := cfg.NewSection(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := yamlSection(section, values); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// iniKinds 返回配置项对应的字段类型，用于转换时还原列表和布尔值
+func iniKinds() map[string]reflect.Kind {
+	kinds := make(map[string]reflect.Kind)
+
+	for _, t := range []reflect.Type{reflect.TypeOf(Settings{}), reflect.TypeOf(Repo{})} {
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("ini"), ",")[0]
+			if name != "" && name != "-" {
+				kinds[name] = t.Field(i).Type.Kind()
+			}
+		}
+	}
+
+	return kinds
+}
+
+func yamlValues(section *ini.Section, kinds map[string]reflect.Kind) yaml.MapSlice {
+	values := yaml.MapSlice{}
+
+	for _, key := range section.Keys() {
+		var value interface{} = key.Value()
+
+		switch kinds[key.Name()] {
+		case reflect.Slice:
+			value = key.Strings(",")
+		case reflect.Bool:
+			if b, err := key.Bool(); err == nil {
+				value = b
+			}
+		}
+
+		values = append(values, yaml.MapItem{Key: key.Name(), Value: value})
+	}
+
+	return values
+}
+
+// ConvertConfig 把 INI 格式的配置文件转换成 YAML，被 include 的文件保持不变
+func ConvertConfig(configPath string) ([]byte, error) {
+	cfg, err := ini.Load(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("配置文件 %s 解析失败: %v", configPath, err)
+	}
+
+	kinds := iniKinds()
+
+	conf := yamlConfig{
+		Settings:     yamlValues(cfg.Section(ini.DEFAULT_SECTION), kinds),
+		Repositories: yaml.MapSlice{},
+	}
+
+	for _, section := range cfg.Sections() {
+		if section.Name() == ini.DEFAULT_SECTION {
+			continue
+		}
+
+		conf.Repositories = append(conf.Repositories, yaml.MapItem{
+			Key:   section.Name(),
+			Value: yamlValues(section, kinds),
+		})
+	}
+
+	return yaml.Marshal(conf)
+}